@@ -0,0 +1,40 @@
+/* C interface to a persistent shuffler of strings backed by RocksDB.
+ *
+ * Link against the aw_shuffle_ffi library built from this crate. A shuffler must only be used
+ * from one thread at a time. */
+#ifndef AW_SHUFFLE_H
+#define AW_SHUFFLE_H
+
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct aw_shuffle_handle aw_shuffler;
+
+/* Opens or creates the database at path. Returns NULL on failure. Strings containing NUL, which
+ * other programs can store, are left in the database but never loaded. */
+aw_shuffler *aw_shuffle_open(const char *path);
+
+/* Returns 1 if item was added, 0 if it was already present, and -1 on failure. */
+int aw_shuffle_add(aw_shuffler *s, const char *item);
+
+/* Returns 1 if item was removed, 0 if it was not present, and -1 on failure. */
+int aw_shuffle_remove(aw_shuffler *s, const char *item);
+
+/* Returns the next item, or NULL if the shuffler is empty or on failure. The string is owned by
+ * the shuffler and is valid until the next call using it. */
+const char *aw_shuffle_next(aw_shuffler *s);
+
+/* Returns the number of items in the shuffler. */
+size_t aw_shuffle_size(const aw_shuffler *s);
+
+/* Flushes the shuffler to disk and frees it. Returns 0 on success and -1 on failure. */
+int aw_shuffle_close(aw_shuffler *s);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
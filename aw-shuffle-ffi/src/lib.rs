@@ -0,0 +1,184 @@
+//! C bindings for a persistent shuffler of strings backed by RocksDB. See
+//! `include/aw_shuffle.h` for the interface.
+//!
+//! Databases are compatible with strpick and any `aw_shuffle::persistent::rocksdb::Shuffler`
+//! storing `String`s.
+#![allow(clippy::missing_safety_doc)]
+
+use std::ffi::{c_char, c_int, CStr, CString};
+use std::path::Path;
+use std::ptr;
+
+use aw_shuffle::persistent::rocksdb::Shuffler;
+use aw_shuffle::persistent::PersistentShuffler;
+use aw_shuffle::AwShuffler;
+
+/// An open shuffler and the last string it returned, which is kept alive until the next call.
+pub struct Handle {
+    shuffler: Shuffler<String>,
+    last: CString,
+}
+
+unsafe fn str_arg<'a>(s: *const c_char) -> Option<&'a str> {
+    if s.is_null() {
+        return None;
+    }
+    unsafe { CStr::from_ptr(s) }.to_str().ok()
+}
+
+/// Opens or creates the database at `path`. Returns NULL on failure.
+///
+/// Strings containing NUL, which other programs can store, are left in the database but never
+/// loaded.
+#[no_mangle]
+pub unsafe extern "C" fn aw_shuffle_open(path: *const c_char) -> *mut Handle {
+    let Some(path) = (unsafe { str_arg(path) }) else {
+        return ptr::null_mut();
+    };
+
+    let Ok(mut shuffler) = Shuffler::<String>::new_default(Path::new(path), None) else {
+        return ptr::null_mut();
+    };
+
+    // Removing them here means a string is never selected and saved without being returned.
+    let unrepresentable: Vec<_> =
+        shuffler.values_where(|s| s.contains('\0')).into_iter().cloned().collect();
+    for item in &unrepresentable {
+        if shuffler.soft_remove(item).is_err() {
+            return ptr::null_mut();
+        }
+    }
+
+    Box::into_raw(Box::new(Handle { shuffler, last: CString::default() }))
+}
+
+/// Adds `item`. Returns 1 if it was added, 0 if it was already present, and -1 on failure.
+#[no_mangle]
+pub unsafe extern "C" fn aw_shuffle_add(s: *mut Handle, item: *const c_char) -> c_int {
+    let (Some(s), Some(item)) = (unsafe { s.as_mut() }, unsafe { str_arg(item) }) else {
+        return -1;
+    };
+
+    match s.shuffler.add(item.to_owned()) {
+        Ok(added) => added.into(),
+        Err(_) => -1,
+    }
+}
+
+/// Removes `item`. Returns 1 if it was removed, 0 if it was not present, and -1 on failure.
+#[no_mangle]
+pub unsafe extern "C" fn aw_shuffle_remove(s: *mut Handle, item: *const c_char) -> c_int {
+    let (Some(s), Some(item)) = (unsafe { s.as_mut() }, unsafe { str_arg(item) }) else {
+        return -1;
+    };
+
+    match s.shuffler.remove(&item.to_owned()) {
+        Ok(removed) => removed.is_some().into(),
+        Err(_) => -1,
+    }
+}
+
+/// Returns the next item, or NULL if the shuffler is empty or on failure. The string is owned by
+/// the shuffler and is valid until the next call using it.
+#[no_mangle]
+pub unsafe extern "C" fn aw_shuffle_next(s: *mut Handle) -> *const c_char {
+    let Some(s) = (unsafe { s.as_mut() }) else {
+        return ptr::null();
+    };
+
+    let next = match s.shuffler.next() {
+        Ok(Some(next)) => next,
+        Ok(None) | Err(_) => return ptr::null(),
+    };
+
+    // Strings containing NUL were removed when opening and can't be added from C.
+    let Ok(next) = CString::new(next.as_str()) else {
+        return ptr::null();
+    };
+
+    s.last = next;
+    s.last.as_ptr()
+}
+
+/// Returns the number of items in the shuffler.
+#[no_mangle]
+pub unsafe extern "C" fn aw_shuffle_size(s: *const Handle) -> usize {
+    unsafe { s.as_ref() }.map_or(0, |s| s.shuffler.size())
+}
+
+/// Closes the shuffler, flushing it to disk, and frees it. Returns 0 on success and -1 on
+/// failure. The shuffler is freed either way.
+#[no_mangle]
+pub unsafe extern "C" fn aw_shuffle_close(s: *mut Handle) -> c_int {
+    if s.is_null() {
+        return -1;
+    }
+
+    let s = unsafe { Box::from_raw(s) };
+    match s.shuffler.close() {
+        Ok(()) => 0,
+        Err(_) => -1,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::PathBuf;
+    use std::{env, fs, process};
+
+    use super::*;
+
+    fn temp_db(name: &str) -> (PathBuf, CString) {
+        let dir = env::temp_dir().join(format!("aw-shuffle-ffi-{}-{name}", process::id()));
+        drop(fs::remove_dir_all(&dir));
+        let path = CString::new(dir.to_str().unwrap()).unwrap();
+        (dir, path)
+    }
+
+    #[test]
+    fn open_add_next_close() {
+        let (dir, path) = temp_db("smoke");
+        let item = CString::new("item").unwrap();
+
+        unsafe {
+            let s = aw_shuffle_open(path.as_ptr());
+            assert!(!s.is_null());
+            assert!(aw_shuffle_next(s).is_null());
+
+            assert_eq!(aw_shuffle_add(s, item.as_ptr()), 1);
+            assert_eq!(aw_shuffle_add(s, item.as_ptr()), 0);
+            assert_eq!(aw_shuffle_size(s), 1);
+            assert_eq!(CStr::from_ptr(aw_shuffle_next(s)), item.as_c_str());
+            assert_eq!(aw_shuffle_close(s), 0);
+
+            let s = aw_shuffle_open(path.as_ptr());
+            assert_eq!(aw_shuffle_size(s), 1);
+            assert_eq!(aw_shuffle_remove(s, item.as_ptr()), 1);
+            assert_eq!(aw_shuffle_close(s), 0);
+        }
+
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn skip_nul() {
+        let (dir, path) = temp_db("nul");
+        let items = vec!["a\0b".to_owned(), "c".to_owned()];
+        Shuffler::new_default(&dir, Some(items)).unwrap().close().unwrap();
+
+        unsafe {
+            let s = aw_shuffle_open(path.as_ptr());
+            assert_eq!(aw_shuffle_size(s), 1);
+            for _ in 0..5 {
+                assert_eq!(CStr::from_ptr(aw_shuffle_next(s)).to_str(), Ok("c"));
+            }
+            assert_eq!(aw_shuffle_close(s), 0);
+        }
+
+        let s = Shuffler::<String>::new_default(&dir, None).unwrap();
+        assert!(s.contains(&"a\0b".to_owned()));
+        s.close().unwrap();
+
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
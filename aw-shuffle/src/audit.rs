@@ -0,0 +1,139 @@
+use crate::{InfallibleShuffler, NewItemHandling, Shuffler};
+
+/// The results of simulating selections with
+/// [`ShufflerGeneric::audit`](crate::ShufflerGeneric::audit).
+///
+/// However strong the bias, every item is selected about equally often over enough selections.
+/// The bias controls how regular the gaps between selections of each item are, so stronger
+/// biases give counts that are closer together than uniformly random selection would.
+#[derive(Debug, Clone)]
+pub struct Audit<'a, T> {
+    /// Every item and the number of times it was selected, from most to least selected.
+    pub counts: Vec<(&'a T, usize)>,
+    /// The number of simulated selections.
+    pub selections: usize,
+}
+
+impl<T> Audit<'_, T> {
+    /// Returns Pearson's chi-squared statistic comparing the counts to a perfectly even
+    /// distribution.
+    ///
+    /// For uniformly random selection this is around
+    /// [`degrees_of_freedom`](Self::degrees_of_freedom). Biased selection should be well below
+    /// that, and 0 means every item was selected the same number of times.
+    pub fn chi_squared(&self) -> f64 {
+        if self.counts.is_empty() || self.selections == 0 {
+            return 0.0;
+        }
+
+        let expected = self.selections as f64 / self.counts.len() as f64;
+        self.counts
+            .iter()
+            .map(|(_, count)| {
+                let diff = *count as f64 - expected;
+                diff * diff / expected
+            })
+            .sum()
+    }
+
+    /// Returns the degrees of freedom for [`chi_squared`](Self::chi_squared), one fewer than the
+    /// number of items.
+    pub fn degrees_of_freedom(&self) -> usize {
+        self.counts.len().saturating_sub(1)
+    }
+}
+
+/// Estimates the bias at which, with `size` items, the median number of selections between
+/// repeats of the same item is `fraction` of `size`. For example, with a fraction of 0.8 half of
+/// all repeats happen only after at least 80% of the collection has been selected.
+///
+/// Even unbiased selection has a median of about 0.69, so smaller fractions return 0. Fractions
+/// of 1 or more return [`f64::INFINITY`], where every item is selected once before any item is
+/// repeated. The default bias of 2 already gives a median slightly above 1.
+///
+/// This simulates selections from a shuffler with [`next`](crate::AwShuffler::next), so the
+/// result is approximate and takes time proportional to `size`. The same arguments always give
+/// the same result.
+///
+/// # Panics
+/// Panics if `size` is 0 or `fraction` is NaN.
+#[must_use]
+pub fn bias_for_median_gap(size: usize, fraction: f64) -> f64 {
+    assert!(size > 0, "size cannot be 0.");
+    assert!(!fraction.is_nan(), "fraction cannot be NaN.");
+
+    if fraction >= 1.0 {
+        return f64::INFINITY;
+    }
+
+    let target = fraction * size as f64;
+    if target <= median_gap(size, 0.0) {
+        return 0.0;
+    }
+
+    let mut low = 0.0;
+    let mut high = 1.0;
+    while median_gap(size, high) < target {
+        if high >= MAX_FINITE_BIAS {
+            return f64::INFINITY;
+        }
+        low = high;
+        high *= 2.0;
+    }
+
+    for _ in 0..20 {
+        let mid = (low + high) / 2.0;
+        if median_gap(size, mid) < target {
+            low = mid;
+        } else {
+            high = mid;
+        }
+    }
+    high
+}
+
+// The median gap is already above the size well before this, so a target that hasn't been
+// reached is noise in the simulation rather than a real limit.
+const MAX_FINITE_BIAS: f64 = 1024.0;
+
+// The median number of selections since each selected item was last selected, once the shuffler
+// has settled into a steady state. Always uses the same seed so results are consistent between
+// biases.
+fn median_gap(size: usize, bias: f64) -> f64 {
+    let mut s = Shuffler::new_seeded(bias, NewItemHandling::NeverSelected, 0);
+    for i in 0..size {
+        s.inf_add(i);
+    }
+
+    // Items not yet selected are treated as last selected at the start, which only understates
+    // their gaps.
+    let mut last = vec![0; size];
+    let mut gaps = Vec::with_capacity(size * 4);
+    for selection in 1..=size * 8 {
+        let i = *s.inf_next().unwrap();
+        let prev = std::mem::replace(&mut last[i], selection);
+        if selection > size * 4 {
+            gaps.push(selection - prev);
+        }
+    }
+
+    let mid = gaps.len() / 2;
+    *gaps.select_nth_unstable(mid).1 as f64
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn bias_for_median_gap() {
+        assert_eq!(super::bias_for_median_gap(100, 0.5), 0.0);
+        assert_eq!(super::bias_for_median_gap(100, 1.0), f64::INFINITY);
+
+        let bias = super::bias_for_median_gap(100, 0.85);
+        assert!(bias > 0.0 && bias.is_finite());
+        assert!(median_gap(100, bias) >= 85.0);
+        assert_eq!(super::bias_for_median_gap(100, 0.85), bias);
+    }
+}
@@ -0,0 +1,240 @@
+use std::sync::{Condvar, Mutex, MutexGuard, PoisonError};
+use std::time::{Duration, Instant};
+
+use crate::AwShuffler;
+
+/// A thread-safe wrapper around a shuffler where selections can block until an item is available,
+/// so it can be used as a weighted work queue between producers and consumers.
+///
+/// Since the shuffler lives behind a lock, selected items are cloned out of it. See
+/// [`metrics`](Self::metrics) for measuring whether that lock is a bottleneck.
+///
+/// Not available on `wasm32-unknown-unknown`, which has no threads to wait for.
+#[derive(Debug)]
+pub struct Blocking<S: AwShuffler> {
+    state: Mutex<State<S>>,
+    added: Condvar,
+}
+
+#[derive(Debug)]
+struct State<S> {
+    shuffler: S,
+    cancelled: bool,
+    metrics: BlockingMetrics,
+}
+
+/// Counters for how long callers of a [`Blocking`] wait for its lock and how long they hold it.
+///
+/// Time spent waiting for items to be added is not counted as waiting for the lock. If waits are
+/// a large fraction of the total time, the shuffler may need to be split between several locks.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub struct BlockingMetrics {
+    /// The number of times the lock was acquired.
+    pub acquisitions: u64,
+    /// The total time spent waiting to acquire the lock.
+    pub lock_wait: Duration,
+    /// The number of operations run on the shuffler, including calls to
+    /// [`with`](Blocking::with).
+    pub operations: u64,
+    /// The total time spent running operations on the shuffler while holding the lock.
+    pub operation_time: Duration,
+}
+
+impl BlockingMetrics {
+    const ZERO: Self = Self {
+        acquisitions: 0,
+        lock_wait: Duration::ZERO,
+        operations: 0,
+        operation_time: Duration::ZERO,
+    };
+}
+
+impl<S: AwShuffler> Blocking<S>
+where
+    S::Item: Clone,
+{
+    /// Wraps `shuffler`.
+    pub const fn new(shuffler: S) -> Self {
+        Self {
+            state: Mutex::new(State { shuffler, cancelled: false, metrics: BlockingMetrics::ZERO }),
+            added: Condvar::new(),
+        }
+    }
+
+    /// Adds the item to the shuffler, waking any threads waiting for an item.
+    ///
+    /// See [`AwShuffler::add`].
+    pub fn add(&self, item: S::Item) -> Result<bool, S::Error> {
+        let added = self.lock().run(|s| s.add(item))?;
+        self.added.notify_all();
+        Ok(added)
+    }
+
+    /// Returns the next item from the shuffler, blocking until one is added if the shuffler is
+    /// empty.
+    ///
+    /// Returns `Ok(None)` if [`cancel`](Self::cancel) is called before an item is available.
+    pub fn wait_next(&self) -> Result<Option<S::Item>, S::Error> {
+        let mut state = self.lock();
+
+        loop {
+            if state.cancelled {
+                return Ok(None);
+            }
+
+            if state.shuffler.size() != 0 {
+                return state.run(|s| s.next().map(|next| next.cloned()));
+            }
+
+            state = self.added.wait(state).unwrap_or_else(PoisonError::into_inner);
+        }
+    }
+
+    /// Like [`wait_next`](Self::wait_next), but gives up and returns `Ok(None)` after waiting
+    /// for `timeout`.
+    pub fn wait_next_timeout(&self, timeout: Duration) -> Result<Option<S::Item>, S::Error> {
+        let deadline = Instant::now() + timeout;
+        let mut state = self.lock();
+
+        loop {
+            if state.cancelled {
+                return Ok(None);
+            }
+
+            if state.shuffler.size() != 0 {
+                return state.run(|s| s.next().map(|next| next.cloned()));
+            }
+
+            let Some(remaining) = deadline.checked_duration_since(Instant::now()) else {
+                return Ok(None);
+            };
+
+            state =
+                self.added.wait_timeout(state, remaining).unwrap_or_else(PoisonError::into_inner).0;
+        }
+    }
+
+    /// Wakes every thread waiting for an item and makes all future waits return `Ok(None)`
+    /// immediately, until [`reset`](Self::reset) is called.
+    pub fn cancel(&self) {
+        self.lock().cancelled = true;
+        self.added.notify_all();
+    }
+
+    /// Undoes [`cancel`](Self::cancel) so waits block until an item is available again.
+    ///
+    /// Threads that were woken by the cancellation but haven't reacquired the lock yet will wait
+    /// again instead of returning, so only call this once the cancelled waits have returned.
+    pub fn reset(&self) {
+        self.lock().cancelled = false;
+    }
+
+    /// Runs `f` with exclusive access to the shuffler. Waiting threads are woken afterwards in
+    /// case `f` added items.
+    pub fn with<O>(&self, f: impl FnOnce(&mut S) -> O) -> O {
+        let out = self.lock().run(f);
+        self.added.notify_all();
+        out
+    }
+
+    /// Returns the metrics collected since the wrapper was created or the metrics were last reset.
+    pub fn metrics(&self) -> BlockingMetrics {
+        self.lock().metrics
+    }
+
+    /// Returns the current metrics and resets them to zero.
+    pub fn reset_metrics(&self) -> BlockingMetrics {
+        std::mem::take(&mut self.lock().metrics)
+    }
+
+    /// Consumes the wrapper and returns the shuffler.
+    pub fn into_inner(self) -> S {
+        self.state.into_inner().unwrap_or_else(PoisonError::into_inner).shuffler
+    }
+
+    // Shufflers don't leave themselves in an inconsistent state when a caller panics.
+    fn lock(&self) -> MutexGuard<'_, State<S>> {
+        let start = Instant::now();
+        let mut state = self.state.lock().unwrap_or_else(PoisonError::into_inner);
+
+        state.metrics.acquisitions += 1;
+        state.metrics.lock_wait += start.elapsed();
+        state
+    }
+}
+
+impl<S> State<S> {
+    fn run<O>(&mut self, f: impl FnOnce(&mut S) -> O) -> O {
+        let start = Instant::now();
+        let out = f(&mut self.shuffler);
+
+        self.metrics.operations += 1;
+        self.metrics.operation_time += start.elapsed();
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+    use std::thread;
+
+    use super::*;
+    use crate::Shuffler;
+
+    #[test]
+    fn wait_next() {
+        let blocking = Arc::new(Blocking::new(Shuffler::default()));
+
+        let consumer = {
+            let blocking = blocking.clone();
+            thread::spawn(move || blocking.wait_next().unwrap())
+        };
+
+        blocking.add(1).unwrap();
+        assert_eq!(consumer.join().unwrap(), Some(1));
+
+        assert_eq!(blocking.wait_next_timeout(Duration::ZERO).unwrap(), Some(1));
+        blocking.with(|s| s.remove(&1)).unwrap();
+        assert_eq!(blocking.wait_next_timeout(Duration::from_millis(1)).unwrap(), None);
+    }
+
+    #[test]
+    fn cancel() {
+        let blocking = Arc::new(Blocking::<Shuffler<u32>>::new(Shuffler::default()));
+
+        let consumer = {
+            let blocking = blocking.clone();
+            thread::spawn(move || blocking.wait_next().unwrap())
+        };
+
+        blocking.cancel();
+        assert_eq!(consumer.join().unwrap(), None);
+        assert_eq!(blocking.wait_next_timeout(Duration::from_secs(60)).unwrap(), None);
+
+        blocking.reset();
+        let consumer = {
+            let blocking = blocking.clone();
+            thread::spawn(move || blocking.wait_next().unwrap())
+        };
+
+        blocking.add(1).unwrap();
+        assert_eq!(consumer.join().unwrap(), Some(1));
+    }
+
+    #[test]
+    fn metrics() {
+        let blocking = Blocking::new(Shuffler::default());
+        blocking.add(1).unwrap();
+        blocking.with(|s| s.add(2)).unwrap();
+        blocking.wait_next().unwrap();
+
+        // Reading the metrics acquires the lock too.
+        let metrics = blocking.reset_metrics();
+        assert_eq!(metrics.acquisitions, 4);
+        assert_eq!(metrics.operations, 3);
+
+        assert_eq!(blocking.metrics().acquisitions, 1);
+        assert_eq!(blocking.metrics().operations, 0);
+    }
+}
@@ -1,6 +1,6 @@
 use std::convert::Infallible;
 
-use crate::{AwShuffler, Item};
+use crate::{AwShuffler, Item, UpToN};
 
 #[allow(clippy::module_name_repetitions)]
 /// In-memory shufflers are infallible. This interface simplifies usage when there are no
@@ -49,6 +49,12 @@ pub trait InfallibleShuffler: AwShuffler {
     ///
     /// Returns `Ok(None)` when the shuffler is empty.
     fn inf_try_unique_n(&mut self, n: usize) -> Option<Vec<&Self::Item>>;
+
+    /// Returns the next `n` unique items, or every item in the shuffler if there are fewer than
+    /// `n`, along with how many items it was short by.
+    ///
+    /// Returns `None` when the shuffler is empty, even if `n` is 0.
+    fn inf_unique_up_to_n(&mut self, n: usize) -> Option<UpToN<&Self::Item>>;
 }
 
 impl<T: Item, S> InfallibleShuffler for S
@@ -78,4 +84,8 @@ where
     fn inf_try_unique_n(&mut self, n: usize) -> Option<Vec<&Self::Item>> {
         self.try_unique_n(n).unwrap()
     }
+
+    fn inf_unique_up_to_n(&mut self, n: usize) -> Option<UpToN<&Self::Item>> {
+        self.unique_up_to_n(n).unwrap()
+    }
 }
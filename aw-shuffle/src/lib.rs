@@ -3,21 +3,41 @@
 #![doc = include_str!("../../README.md")]
 use std::convert::Infallible;
 use std::error::Error;
-use std::hash::{Hash, Hasher};
+use std::hash::{BuildHasher, Hash, Hasher};
 use std::num::NonZeroU64;
+use std::ptr::NonNull;
 
-use ahash::AHasher;
+use ahash::{AHashMap, AHasher, RandomState};
 use rand::distributions::Uniform;
 use rand::prelude::{Distribution, StdRng};
 use rand::{Rng, SeedableRng};
 use rbtree::{Node, Rbtree};
 
+mod audit;
+// Browsers have no threads to block or clock to time them with.
+#[cfg(not(all(target_arch = "wasm32", target_os = "unknown")))]
+mod blocking;
 mod infallible;
+mod mirrored;
+mod multi;
 #[cfg(feature = "persistent")]
 pub mod persistent;
 mod rbtree;
-
+mod read_only;
+mod schedule;
+mod settings;
+#[cfg(any(test, feature = "testing"))]
+pub mod testing;
+
+pub use audit::{bias_for_median_gap, Audit};
+#[cfg(not(all(target_arch = "wasm32", target_os = "unknown")))]
+pub use blocking::{Blocking, BlockingMetrics};
 pub use infallible::*;
+pub use mirrored::{MirrorError, MirrorPolicy, Mirrored};
+pub use multi::MultiShuffler;
+pub use read_only::ReadOnly;
+pub use schedule::BiasSchedule;
+pub use settings::Settings;
 
 #[doc(hidden)]
 // Just for benchmarking
@@ -98,9 +118,26 @@ pub trait AwShuffler: private::Sealed {
         if s == 0 || s < n { self.next_n(n) } else { self.unique_n(n) }
     }
 
+    /// Returns the next `n` unique items, or every item in the shuffler if there are fewer than
+    /// `n`, along with how many items it was short by. Unlike
+    /// [`try_unique_n`](Self::try_unique_n), items are never repeated.
+    ///
+    /// Returns `Ok(None)` when the shuffler is empty, even if `n` is 0.
+    fn unique_up_to_n(&mut self, n: usize) -> Result<Option<UpToN<&Self::Item>>, Self::Error> {
+        let s = self.size();
+        let short_by = n.saturating_sub(s);
+        Ok(self.unique_n(n - short_by)?.map(|items| UpToN { items, short_by }))
+    }
+
     /// Returns the number of items currently in the shuffler.
     fn size(&self) -> usize;
 
+    /// Returns `true` if the item is currently in the shuffler.
+    ///
+    /// For [`PersistentShuffler`](persistent::PersistentShuffler)s this only checks the items
+    /// currently loaded in memory.
+    fn contains(&self, item: &Self::Item) -> bool;
+
     /// Returns all of the values currently in the shuffler in no specific order.
     ///
     /// For [`PersistentShuffler`](persistent::PersistentShuffler)s this only counts the items
@@ -131,15 +168,35 @@ mod private {
 
     use rand::Rng;
 
+    use crate::rbtree::Node;
     use crate::{Item, ShufflerGeneric};
 
     pub trait Sealed {}
 
     impl<T: Item, H: Hasher + Clone, R: Rng> Sealed for ShufflerGeneric<T, H, R> {}
+
+    // Lets a shuffler act as the secondary of a Mirrored shuffler by copying selections made
+    // elsewhere. Items that aren't present are ignored.
+    pub trait MarkSelected: crate::AwShuffler {
+        fn mark_selected(&mut self, items: &[&Self::Item]) -> Result<(), Self::Error>;
+    }
+
+    impl<T: Item, H: Hasher + Clone, R: Rng> MarkSelected for ShufflerGeneric<T, H, R> {
+        fn mark_selected(&mut self, items: &[&T]) -> Result<(), Self::Error> {
+            let (gen, _) = self.next_generation();
+
+            for item in items {
+                if let Some(node) = self.tree.find_node(item) {
+                    Node::set_generation(node, gen.get());
+                }
+            }
+            Ok(())
+        }
+    }
 }
 
 /// How items should be treated when they're first added to the shuffler.
-#[derive(Debug)]
+#[derive(Debug, Clone, Copy)]
 pub enum NewItemHandling {
     /// Treat new items as if they had never been selected, making them very likely to be selected
     /// next. Gives new items the same weight as the least recently selected item.
@@ -152,9 +209,27 @@ pub enum NewItemHandling {
     Random,
 }
 
+/// The items returned by [`AwShuffler::unique_up_to_n`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct UpToN<I> {
+    /// The selected items, which are all unique.
+    pub items: Vec<I>,
+    /// How many fewer items were selected than were requested.
+    pub short_by: usize,
+}
+
+impl<I> UpToN<I> {
+    /// Returns `true` if fewer items were selected than were requested.
+    pub const fn is_short(&self) -> bool {
+        self.short_by != 0
+    }
+}
+
 /// Standard in-memory shuffler with no persistence. All data tracking how recently items were
 /// selected only lives as long as this struct.
 ///
+/// Selecting single items with [`next`](AwShuffler::next) never allocates.
+///
 /// See the documentation for [`AwShuffler`] and [`InfallibleShuffler`] for more information.
 #[derive(Debug)]
 pub struct ShufflerGeneric<T: Item, H: Hasher + Clone, R: Rng> {
@@ -162,8 +237,23 @@ pub struct ShufflerGeneric<T: Item, H: Hasher + Clone, R: Rng> {
     rng: R,
     bias: f64,
     new_items: NewItemHandling,
+    // The schedule and the number of selections made since it was set.
+    schedule: Option<(BiasSchedule, u64)>,
+    strict: bool,
+    weight: Option<WeightFn<T>>,
 }
 
+struct WeightFn<T>(Box<dyn Fn(&T) -> f64 + Send + Sync>);
+
+impl<T> std::fmt::Debug for WeightFn<T> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("WeightFn")
+    }
+}
+
+// How many candidates are considered before giving up and selecting the heaviest of them.
+const WEIGHT_ATTEMPTS: usize = 32;
+
 
 /// Type alias for [`ShufflerGeneric`] with the default hasher and rng implementations.
 pub type Shuffler<T> = ShufflerGeneric<T, AHasher, StdRng>;
@@ -176,6 +266,9 @@ impl<T: Item> Default for Shuffler<T> {
             rng: StdRng::from_entropy(),
             bias: 2.0,
             new_items: NewItemHandling::NeverSelected,
+            schedule: None,
+            strict: false,
+            weight: None,
         }
     }
 }
@@ -201,6 +294,37 @@ impl<T: Item> Shuffler<T> {
             rng: StdRng::from_entropy(),
             bias,
             new_items: new_item_handling,
+            schedule: None,
+            strict: false,
+            weight: None,
+        }
+    }
+
+    /// Creates a new Shuffler like [`new`](Self::new), but with its random number generator and
+    /// hasher initialized from `seed`. Two shufflers created with the same seed will return the
+    /// same results when given the same sequence of operations.
+    ///
+    /// This is meant for tests and demonstrations. Results are only reproducible between builds
+    /// using the same versions of this crate and its dependencies on the same platform.
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN bias.
+    #[must_use]
+    pub fn new_seeded(bias: f64, new_item_handling: NewItemHandling, seed: u64) -> Self {
+        assert!(!bias.is_nan(), "bias {bias} cannot be NaN.");
+        assert!(bias.is_sign_positive(), "bias {bias} cannot be negative.");
+
+        let hasher =
+            RandomState::with_seeds(seed, !seed, seed.rotate_left(32), !seed.rotate_left(32));
+
+        Self {
+            tree: Rbtree::new(hasher.build_hasher()),
+            rng: StdRng::seed_from_u64(seed),
+            bias,
+            new_items: new_item_handling,
+            schedule: None,
+            strict: false,
+            weight: None,
         }
     }
 }
@@ -220,11 +344,13 @@ where
     /// `f64::INFINITY` will cause it to only return the least-recently selected items. The default
     /// `bias` is 2.0.
     ///
+    /// Combined with a fixed hasher and a `testing::SequenceRng` from the `testing` feature this
+    /// makes selections fully reproducible in tests.
+    ///
     /// # Panics
     /// Panics if given a negative or NaN bias.
     #[must_use]
-    #[allow(dead_code)]
-    fn new_custom(bias: f64, new_item_handling: NewItemHandling, hasher: H, rng: R) -> Self {
+    pub fn new_custom(bias: f64, new_item_handling: NewItemHandling, hasher: H, rng: R) -> Self {
         assert!(!bias.is_nan(), "bias {bias} cannot be NaN.");
         assert!(bias.is_sign_positive(), "bias {bias} cannot be negative.");
 
@@ -233,6 +359,305 @@ where
             rng,
             bias,
             new_items: new_item_handling,
+            schedule: None,
+            strict: false,
+            weight: None,
+        }
+    }
+
+    /// Returns an iterator over the items currently in the shuffler in no specific order. Unlike
+    /// [`values`](AwShuffler::values) this doesn't allocate.
+    pub fn iter(&self) -> impl ExactSizeIterator<Item = &T> + '_ {
+        self.tree.iter().map(|(item, _)| item)
+    }
+
+    /// Returns up to `limit` items following `after`, for showing the contents of large
+    /// shufflers in pages. Pass `None` for the first page and the last item of the previous page
+    /// for each page after.
+    ///
+    /// Items are returned in an arbitrary but consistent order, so adding or removing other items
+    /// between pages, or even removing `after`, never causes items to be repeated or skipped.
+    /// Items added between pages may or may not be included in later pages.
+    pub fn values_page(&self, after: Option<&T>, limit: usize) -> Vec<&T> {
+        let iter = match after {
+            Some(after) => self.tree.iter_after(after),
+            None => self.tree.iter(),
+        };
+
+        iter.take(limit).map(|(item, _)| item).collect()
+    }
+
+    /// Returns the items for which `pred` returns `true`, in no specific order. Unlike filtering
+    /// [`values`](AwShuffler::values) this only allocates space for the matching items.
+    ///
+    /// Items are ordered by their hashes, not their values, so every item has to be checked.
+    pub fn values_where(&self, mut pred: impl FnMut(&T) -> bool) -> Vec<&T> {
+        self.iter().filter(|item| pred(item)).collect()
+    }
+
+    /// Returns the items starting with `prefix`, in no specific order. See
+    /// [`values_where`](Self::values_where).
+    pub fn values_with_prefix(&self, prefix: &str) -> Vec<&T>
+    where
+        T: AsRef<str>,
+    {
+        self.values_where(|item| item.as_ref().starts_with(prefix))
+    }
+
+    /// Counts the items in each of up to `buckets` equally sized ranges of generations, from the
+    /// oldest generation to the newest, to show how evenly the items are being cycled through.
+    ///
+    /// Returns the first generation in each range along with its count, which can be 0 for ranges
+    /// no item currently falls in. The ranges cover every generation from the oldest to the
+    /// newest, inclusive, so there are never more ranges than that span, and rounding the width of
+    /// each range up can leave fewer than `buckets` of them. There are none when the shuffler is
+    /// empty or `buckets` is 0.
+    pub fn generation_histogram(&self, buckets: usize) -> Vec<(u64, usize)> {
+        if self.tree.size() == 0 || buckets == 0 {
+            return Vec::new();
+        }
+
+        let (min_gen, max_gen) = self.tree.generations();
+        // The span can't overflow a u128 even when every generation is in use.
+        let span = u128::from(max_gen - min_gen) + 1;
+        let width = span.div_ceil(buckets as u128);
+        let buckets = span.div_ceil(width) as usize;
+
+        let mut counts = vec![0; buckets];
+        for (_, gen) in self.tree.iter() {
+            counts[(u128::from(gen - min_gen) / width) as usize] += 1;
+        }
+
+        counts
+            .into_iter()
+            .enumerate()
+            .map(|(i, count)| (min_gen + (i as u128 * width) as u64, count))
+            .collect()
+    }
+
+    /// Selects an item as in [`next`](AwShuffler::next), then returns it along with up to `k - 1`
+    /// items that immediately follow it when sorted by their [`Ord`] implementation, for
+    /// selecting contiguous runs of items. Fewer items are returned when the first item is near
+    /// the end.
+    ///
+    /// All the returned items will be treated as having been selected at the same time for future
+    /// calls. Finding the following items takes time linear in the number of items.
+    ///
+    /// Returns `None` when the shuffler is empty, even if `k` is 0.
+    pub fn next_run(&mut self, k: usize) -> Option<Vec<&T>> {
+        if self.tree.size() == 0 {
+            return None;
+        }
+        if k == 0 {
+            return Some(Vec::new());
+        }
+
+        self.apply_schedule(k);
+        let first = self.find_one();
+        let (next_gen, _) = self.next_generation();
+        let first = unsafe { first.as_ref() }.get();
+
+        let mut run: Vec<_> =
+            self.tree.iter().map(|(item, _)| item).filter(|item| *item > first).collect();
+        if run.len() > k - 1 {
+            run.select_nth_unstable(k - 1);
+            run.truncate(k - 1);
+        }
+        run.sort_unstable();
+        run.insert(0, first);
+
+        for item in &run {
+            // Every item came from the tree.
+            Node::set_generation(self.tree.find_node(item).unwrap(), next_gen.get());
+        }
+
+        Some(run)
+    }
+
+    /// Removes every item for which `pred` returns `true` and returns them. `pred` is called
+    /// once for each item along with the generation it was last selected in.
+    ///
+    /// This is more efficient than filtering [`dump`](AwShuffler::dump) and calling
+    /// [`remove`](AwShuffler::remove) for each item, as the items are found in a single pass.
+    pub fn remove_where(&mut self, pred: impl FnMut(&T, u64) -> bool) -> Vec<T> {
+        self.tree.remove_where(pred)
+    }
+
+    /// Simulates `selections` calls to [`next`](AwShuffler::next) on a copy of the shuffler and
+    /// counts how often each item is selected, to check that the bias produces the expected
+    /// distribution. The shuffler itself is not changed.
+    ///
+    /// The simulation uses the current bias, [`BiasSchedule`], and strict rotation setting with
+    /// its own random number generator. The weight function is not used.
+    pub fn audit(&self, selections: usize) -> Audit<'_, T> {
+        let mut sim = ShufflerGeneric {
+            tree: Rbtree::new(self.tree.hasher().clone()),
+            rng: StdRng::from_entropy(),
+            bias: self.bias,
+            new_items: self.new_items,
+            schedule: self.schedule.clone(),
+            strict: self.strict,
+            weight: None,
+        };
+        for (item, gen) in self.tree.iter() {
+            sim.tree.insert(item, gen);
+        }
+
+        let mut counts: AHashMap<_, _> = self.iter().map(|item| (item, 0)).collect();
+        for _ in 0..selections {
+            let Some(item) = sim.inf_next() else {
+                break;
+            };
+            // Every item in the simulation is in counts.
+            *counts.get_mut(*item).unwrap() += 1;
+        }
+
+        let mut counts: Vec<_> = counts.into_iter().collect();
+        counts.sort_unstable_by(|a, b| b.1.cmp(&a.1).then_with(|| a.0.cmp(b.0)));
+
+        let selections = if counts.is_empty() { 0 } else { selections };
+        Audit { counts, selections }
+    }
+
+    /// Writes the shuffler's settings and the contents of its internal tree, for including in bug
+    /// reports. Each item is written on its own line, in the tree's order and indented by its
+    /// depth, with its generation, the range of generations in its subtree, and its colour.
+    ///
+    /// The format is not stable and the output is proportional to the number of items.
+    pub fn write_debug(&self, f: &mut impl std::fmt::Write) -> std::fmt::Result
+    where
+        T: std::fmt::Debug,
+    {
+        let (min_gen, max_gen) = self.tree.generations();
+        writeln!(
+            f,
+            "bias: {}, schedule: {}, strict: {}, new items: {:?}, weighted: {}",
+            self.bias,
+            self.schedule.is_some(),
+            self.strict,
+            self.new_items,
+            self.weight.is_some()
+        )?;
+        writeln!(f, "size: {}, generations: [{min_gen},{max_gen}]", self.tree.size())?;
+        self.tree.write_debug(f)
+    }
+
+    /// Returns the output of [`write_debug`](Self::write_debug) as a string.
+    pub fn debug_string(&self) -> String
+    where
+        T: std::fmt::Debug,
+    {
+        let mut s = String::new();
+        // Writing to a String can't fail.
+        self.write_debug(&mut s).unwrap();
+        s
+    }
+
+    /// Checks the internal consistency of the shuffler, returning a description of the first
+    /// problem found.
+    ///
+    /// This should never fail. A failure indicates a bug in aw-shuffle or an item being mutated
+    /// in a way that changes its hash or ordering.
+    pub fn check_integrity(&self) -> Result<(), &'static str> {
+        self.tree.check()
+    }
+
+    /// Returns how many more selections can be made before the generation counter overflows and
+    /// every item's generation is reset, forgetting how recently each item was selected.
+    ///
+    /// Each call to [`next`](AwShuffler::next), [`next_n`](AwShuffler::next_n), or
+    /// [`unique_n`](AwShuffler::unique_n) uses one generation, so this is only a concern for
+    /// very long-lived shufflers.
+    pub const fn generation_headroom(&self) -> u64 {
+        u64::MAX - self.tree.generations().1
+    }
+
+    /// Returns the current bias. With a [`BiasSchedule`] this is the bias used for the most recent
+    /// selection.
+    pub const fn bias(&self) -> f64 {
+        self.bias
+    }
+
+    /// Changes the bias, removing any [`BiasSchedule`]. See [`Shuffler::new`].
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN bias.
+    pub fn set_bias(&mut self, bias: f64) {
+        assert!(!bias.is_nan(), "bias {bias} cannot be NaN.");
+        assert!(bias.is_sign_positive(), "bias {bias} cannot be negative.");
+
+        self.bias = bias;
+        self.schedule = None;
+    }
+
+    /// Changes the bias automatically according to `schedule` before each selection, replacing any
+    /// existing schedule.
+    pub fn set_bias_schedule(&mut self, schedule: BiasSchedule) {
+        self.bias = schedule.bias(0);
+        self.schedule = Some((schedule, 0));
+    }
+
+    /// Enables or disables strict rotation, where selections are made uniformly at random from
+    /// only the least recently selected items, ignoring the bias.
+    ///
+    /// Every item is selected exactly once before any item is selected again, in an order that
+    /// doesn't depend on the items themselves. An infinite bias also only selects the least
+    /// recently selected items, but favours those that come after long runs of other items in the
+    /// shuffler's internal order.
+    pub fn set_strict_rotation(&mut self, strict: bool) {
+        self.strict = strict;
+    }
+
+    /// Sets a function that weights items at selection time, between 0 and 1, on top of the
+    /// weighting from how recently they were selected. An item with a weight of 0.5 is half as
+    /// likely to be selected as it otherwise would be. Weights outside that range are clamped and
+    /// NaN is treated as 0.
+    ///
+    /// The function is called on each candidate item during every selection, so it can reflect
+    /// changing information, but it should be cheap. Callers are responsible for caching anything
+    /// expensive to compute.
+    ///
+    /// Candidates are rejected randomly based on their weights. If every candidate is rejected
+    /// after a limited number of attempts, the heaviest candidate is selected instead, so
+    /// shufflers where every item has a weight of 0 still select items.
+    pub fn set_weight_fn(&mut self, weight: impl Fn(&T) -> f64 + Send + Sync + 'static) {
+        self.weight = Some(WeightFn(Box::new(weight)));
+    }
+
+    /// Removes the function set by [`set_weight_fn`](Self::set_weight_fn).
+    pub fn clear_weight_fn(&mut self) {
+        self.weight = None;
+    }
+
+    /// Returns the current settings, which can be applied to other shufflers with
+    /// [`apply_settings`](Self::apply_settings).
+    pub fn settings(&self) -> Settings {
+        Settings {
+            bias: self.bias,
+            new_item_handling: self.new_items,
+            bias_schedule: self.schedule.as_ref().map(|(schedule, _)| schedule.clone()),
+            strict_rotation: self.strict,
+        }
+    }
+
+    /// Replaces the settings of this shuffler with `settings`. Items and the data tracking how
+    /// recently they were selected are not changed.
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN bias.
+    pub fn apply_settings(&mut self, settings: Settings) {
+        self.set_bias(settings.bias);
+        if let Some(schedule) = settings.bias_schedule {
+            self.set_bias_schedule(schedule);
+        }
+        self.new_items = settings.new_item_handling;
+        self.strict = settings.strict_rotation;
+    }
+
+    fn apply_schedule(&mut self, selections: usize) {
+        if let Some((schedule, count)) = &mut self.schedule {
+            self.bias = schedule.bias(*count);
+            *count = count.saturating_add(selections as u64);
         }
     }
 
@@ -276,6 +701,52 @@ where
         self.random_generation_internal(min_gen, max_gen)
     }
 
+    // Without a weight function this returns the first candidate.
+    fn find_weighted(
+        &mut self,
+        mut candidate: impl FnMut(&mut Self) -> NonNull<Node<T>>,
+    ) -> NonNull<Node<T>> {
+        let mut heaviest = None;
+
+        for _ in 0..WEIGHT_ATTEMPTS {
+            let node = candidate(self);
+            let Some(weight) = &self.weight else {
+                return node;
+            };
+
+            let w = (weight.0)(unsafe { node.as_ref() }.get());
+            let w = if w.is_nan() { 0.0 } else { w.clamp(0.0, 1.0) };
+            if self.rng.gen::<f64>() < w {
+                return node;
+            }
+
+            if !heaviest.is_some_and(|(_, h)| h >= w) {
+                heaviest = Some((node, w));
+            }
+        }
+
+        heaviest.expect("WEIGHT_ATTEMPTS is not 0").0
+    }
+
+    // Finds a single item to select, as in next(). The tree must not be empty.
+    fn find_one(&mut self) -> NonNull<Node<T>> {
+        let size = self.tree.size();
+
+        self.find_weighted(|s| {
+            if s.strict {
+                return s.find_strict();
+            }
+            let random_gen = s.random_generation();
+            let index = s.rng.gen_range(0..size);
+            s.tree.find_next(index, random_gen)
+        })
+    }
+
+    fn find_strict(&mut self) -> NonNull<Node<T>> {
+        let i = self.rng.gen_range(0..self.tree.oldest_count());
+        self.tree.find_oldest(i)
+    }
+
     fn random_generation_internal(&mut self, min_gen: u64, max_gen: u64) -> u64 {
         if min_gen == max_gen {
             return max_gen;
@@ -320,10 +791,8 @@ where
             return Ok(None);
         }
 
-        let random_gen = self.random_generation();
-        let index = self.rng.gen_range(0..size);
-
-        let node = self.tree.find_next(index, random_gen);
+        self.apply_schedule(1);
+        let node = self.find_one();
         let (next_gen, _) = self.next_generation();
 
         Node::set_generation(node, next_gen.get());
@@ -337,6 +806,7 @@ where
             return Ok(None);
         }
 
+        self.apply_schedule(n);
         let index_range = Uniform::new(0, size);
         let mut selected = Vec::with_capacity(n);
 
@@ -344,10 +814,14 @@ where
         // It's possible to have reset the tree here but it's not worth optimizing for.
 
         for _ in 0..n {
-            let random_gen = self.random_generation();
-            let index = index_range.sample(&mut self.rng);
-
-            let node = self.tree.find_next(index, random_gen);
+            let node = self.find_weighted(|s| {
+                if s.strict {
+                    return s.find_strict();
+                }
+                let random_gen = s.random_generation();
+                let index = index_range.sample(&mut s.rng);
+                s.tree.find_next(index, random_gen)
+            });
 
             // Set the generation here to try to prioritize other items.
             Node::set_generation(node, next_gen.get());
@@ -367,6 +841,7 @@ where
             return Ok(None);
         }
 
+        self.apply_schedule(n);
         let index_range = Uniform::new(0, size);
         let mut selected = Vec::with_capacity(n);
 
@@ -374,10 +849,15 @@ where
         // It's possible to have reset the tree here but it's not worth optimizing for.
 
         for _ in 0..n {
-            let random_gen = self.random_generation_below(next_gen);
-            let index = index_range.sample(&mut self.rng);
-
-            let node = self.tree.find_next(index, random_gen);
+            // Items already selected are never the oldest while fewer than size have been selected.
+            let node = self.find_weighted(|s| {
+                if s.strict {
+                    return s.find_strict();
+                }
+                let random_gen = s.random_generation_below(next_gen);
+                let index = index_range.sample(&mut s.rng);
+                s.tree.find_next(index, random_gen)
+            });
 
             // Set the generation here to try to prioritize other items.
             Node::set_generation(node, next_gen.get());
@@ -395,6 +875,10 @@ where
         self.tree.size()
     }
 
+    fn contains(&self, item: &Self::Item) -> bool {
+        self.tree.find_node(item).is_some()
+    }
+
     fn values(&self) -> Vec<&Self::Item> {
         self.tree.values()
     }
@@ -410,48 +894,23 @@ where
 
 #[cfg(test)]
 mod tests {
-    use rand::RngCore;
-
     use crate::rbtree::tests::DummyHasher;
     use crate::rbtree::Rbtree;
-    use crate::{AwShuffler, InfallibleShuffler, NewItemHandling, ShufflerGeneric};
+    use crate::testing::SequenceRng;
+    use crate::{
+        AwShuffler, BiasSchedule, InfallibleShuffler, NewItemHandling, Shuffler, ShufflerGeneric,
+    };
 
 
-    #[derive(Default)]
-    struct DummyRandom {
-        vals: Vec<u64>,
-        index: usize,
-    }
-
-    impl RngCore for DummyRandom {
-        fn next_u32(&mut self) -> u32 {
-            self.next_u64() as u32
-        }
-
-        fn next_u64(&mut self) -> u64 {
-            if self.vals.is_empty() {
-                return 0;
-            }
-            let v = self.vals[self.index];
-            self.index = (self.index + 1) % self.vals.len();
-            v
-        }
-
-        fn fill_bytes(&mut self, _dest: &mut [u8]) {
-            unimplemented!()
-        }
-
-        fn try_fill_bytes(&mut self, _dest: &mut [u8]) -> Result<(), rand::Error> {
-            unimplemented!()
-        }
-    }
-
-    fn new_default_leftmost_oldest() -> ShufflerGeneric<&'static str, DummyHasher, DummyRandom> {
+    fn new_default_leftmost_oldest() -> ShufflerGeneric<&'static str, DummyHasher, SequenceRng> {
         ShufflerGeneric {
             tree: Rbtree::new_dummy(&[]),
-            rng: DummyRandom::default(),
+            rng: SequenceRng::default(),
             bias: f64::INFINITY,
             new_items: NewItemHandling::NeverSelected,
+            schedule: None,
+            strict: false,
+            weight: None,
         }
     }
 
@@ -576,4 +1035,224 @@ mod tests {
         let expected = ["d", "a", "b", "c", "e"];
         v.into_iter().zip(expected.iter()).for_each(|(a, b)| assert_eq!(a, b));
     }
+
+    #[test]
+    fn seeded() {
+        let items: Vec<_> = (0..100).collect();
+
+        let mut a = Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1234);
+        let mut b = Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1234);
+
+        // Insertion order does not affect the results.
+        items.iter().for_each(|i| assert!(a.inf_add(*i)));
+        items.iter().rev().for_each(|i| assert!(b.inf_add(*i)));
+
+        for _ in 0..50 {
+            assert_eq!(a.inf_next(), b.inf_next());
+        }
+        assert_eq!(a.inf_next_n(20), b.inf_next_n(20));
+        assert_eq!(a.inf_unique_n(20), b.inf_unique_n(20));
+    }
+
+    #[test]
+    fn generation_histogram() {
+        // Only the least recently selected items are selected, so each one is distinct.
+        let mut shuffler = Shuffler::new(f64::INFINITY, NewItemHandling::NeverSelected);
+        assert!(shuffler.generation_histogram(4).is_empty());
+
+        for i in 0..10 {
+            shuffler.inf_add(i);
+        }
+        assert_eq!(shuffler.generation_histogram(4), vec![(0, 10)]);
+
+        // Generations 1 through 5, one item each, with the other five still at 0.
+        for _ in 0..5 {
+            shuffler.inf_unique_n(1);
+        }
+        assert_eq!(shuffler.generation_histogram(0), vec![]);
+        assert_eq!(shuffler.generation_histogram(3), vec![(0, 6), (2, 2), (4, 2)]);
+        assert_eq!(shuffler.generation_histogram(100).len(), 6);
+    }
+
+    #[test]
+    fn strict_rotation() {
+        let mut shuffler = Shuffler::new_seeded(0.0, NewItemHandling::NeverSelected, 1);
+        shuffler.set_strict_rotation(true);
+        for i in 0..10 {
+            shuffler.inf_add(i);
+        }
+
+        let mut picked: Vec<_> = (0..4).map(|_| *shuffler.inf_next().unwrap()).collect();
+        picked.extend(shuffler.inf_unique_n(3).unwrap());
+        picked.extend(shuffler.inf_next_n(3).unwrap());
+        picked.sort_unstable();
+        assert_eq!(picked, (0..10).collect::<Vec<_>>());
+        assert_eq!(shuffler.check_integrity(), Ok(()));
+
+        // Every item is used once before any are repeated, even across calls.
+        let mut picked = shuffler.inf_next_n(15).unwrap();
+        picked.truncate(10);
+        picked.sort_unstable();
+        picked.dedup();
+        assert_eq!(picked.len(), 10);
+    }
+
+    #[test]
+    fn weight_fn() {
+        let mut shuffler = Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1);
+        for i in 0..10 {
+            shuffler.inf_add(i);
+        }
+
+        shuffler.set_weight_fn(|i| if i % 2 == 0 { 1.0 } else { 0.0 });
+        for _ in 0..20 {
+            assert_eq!(shuffler.inf_next().unwrap() % 2, 0);
+        }
+        assert!(shuffler.inf_next_n(3).unwrap().iter().all(|i| *i % 2 == 0));
+        assert_eq!(shuffler.inf_unique_n(10).unwrap().len(), 10);
+
+        // Items are still selected when every item is rejected.
+        shuffler.set_weight_fn(|_| f64::NAN);
+        assert!(shuffler.inf_next().is_some());
+
+        shuffler.clear_weight_fn();
+        assert_eq!(shuffler.inf_unique_n(10).unwrap().len(), 10);
+    }
+
+    #[test]
+    fn next_run() {
+        let mut shuffler = Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1);
+        assert_eq!(shuffler.next_run(3), None);
+
+        for i in 0..10 {
+            shuffler.inf_add(i);
+        }
+        assert_eq!(shuffler.next_run(0), Some(vec![]));
+
+        for _ in 0..10 {
+            let run: Vec<_> = shuffler.next_run(3).unwrap().into_iter().copied().collect();
+            let first = run[0];
+            assert_eq!(run, (first..(first + 3).min(10)).collect::<Vec<_>>());
+
+            let (_, newest) = shuffler.tree.generations();
+            let selected = shuffler.dump().into_iter().filter(|(_, g)| *g == newest).count();
+            assert_eq!(selected, run.len());
+        }
+        assert_eq!(shuffler.check_integrity(), Ok(()));
+    }
+
+    #[test]
+    fn values_where() {
+        let mut shuffler = Shuffler::default();
+        for s in ["apple", "apricot", "banana", "cherry"] {
+            shuffler.inf_add(s.to_string());
+        }
+
+        let mut odd = shuffler.values_where(|s| s.len() % 2 == 1);
+        odd.sort_unstable();
+        assert_eq!(odd, vec!["apple", "apricot"]);
+
+        let mut ap = shuffler.values_with_prefix("ap");
+        ap.sort_unstable();
+        assert_eq!(ap, vec!["apple", "apricot"]);
+        assert_eq!(shuffler.values_with_prefix("c"), vec!["cherry"]);
+        assert!(shuffler.values_with_prefix("d").is_empty());
+        assert_eq!(shuffler.values_with_prefix("").len(), 4);
+    }
+
+    #[test]
+    fn remove_where() {
+        let mut shuffler = Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1);
+        for i in 0..10 {
+            shuffler.inf_add(i);
+        }
+
+        let mut removed = shuffler.remove_where(|i, _| i % 2 == 0);
+        removed.sort_unstable();
+        assert_eq!(removed, vec![0, 2, 4, 6, 8]);
+        assert_eq!(shuffler.size(), 5);
+        assert!(!shuffler.contains(&4));
+        assert!(shuffler.contains(&5));
+
+        let selected = *shuffler.inf_next().unwrap();
+        assert_eq!(shuffler.remove_where(|_, gen| gen > 0), vec![selected]);
+        assert_eq!(shuffler.check_integrity(), Ok(()));
+    }
+
+    #[test]
+    fn settings() {
+        let mut source = Shuffler::<u32>::new(3.0, NewItemHandling::RecentlySelected);
+        source.set_strict_rotation(true);
+
+        let mut target = Shuffler::<u32>::default();
+        target.apply_settings(source.settings());
+        assert_eq!(target.bias(), 3.0);
+        assert!(matches!(target.new_items, NewItemHandling::RecentlySelected));
+        assert!(target.strict);
+        assert!(target.schedule.is_none());
+
+        source.set_bias_schedule(BiasSchedule::by_selections([(0, 1.0), (10, 5.0)]));
+        target.apply_settings(source.settings());
+        assert_eq!(target.bias(), 1.0);
+        assert!(target.schedule.is_some());
+    }
+
+    #[test]
+    fn generation_headroom() {
+        let mut shuffler = ShufflerGeneric::default();
+        assert_eq!(shuffler.generation_headroom(), u64::MAX);
+
+        shuffler.inf_add(0);
+        shuffler.inf_next_n(3);
+        assert_eq!(shuffler.generation_headroom(), u64::MAX - 1);
+    }
+
+    #[test]
+    fn debug_string() {
+        let mut shuffler = new_default_leftmost_oldest();
+        shuffler.add("a").unwrap();
+        shuffler.add("b").unwrap();
+        shuffler.next().unwrap();
+
+        assert_eq!(
+            shuffler.debug_string(),
+            "bias: inf, schedule: false, strict: false, new items: NeverSelected, weighted: false\n\
+             size: 2, generations: [0,1]\n\
+             \"a\": 1 [0,1], black\n  \"b\": 0 [0,0], red\n"
+        );
+    }
+
+    // Weight functions are shared with the shuffler, so they must not stop it from being Sync.
+    #[test]
+    fn send_sync() {
+        fn assert_send_sync<T: Send + Sync>(_: &T) {}
+
+        let mut shuffler = Shuffler::default();
+        shuffler.set_weight_fn(|i: &u32| f64::from(*i));
+        assert_send_sync(&shuffler);
+    }
+
+    #[test]
+    fn audit() {
+        let mut shuffler = Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1);
+        assert_eq!(shuffler.audit(10).selections, 0);
+
+        for i in 0..10 {
+            shuffler.inf_add(i);
+        }
+        let before: Vec<_> = shuffler.dump().into_iter().map(|(i, g)| (*i, g)).collect();
+
+        let audit = shuffler.audit(1000);
+        assert_eq!(audit.counts.len(), 10);
+        assert_eq!(audit.counts.iter().map(|(_, c)| c).sum::<usize>(), 1000);
+        assert_eq!(audit.degrees_of_freedom(), 9);
+
+        let after: Vec<_> = shuffler.dump().into_iter().map(|(i, g)| (*i, g)).collect();
+        assert_eq!(before, after);
+
+        shuffler.set_strict_rotation(true);
+        let audit = shuffler.audit(100);
+        assert!(audit.counts.iter().all(|(_, c)| *c == 10));
+        assert_eq!(audit.chi_squared(), 0.0);
+    }
 }
@@ -0,0 +1,234 @@
+use std::error::Error;
+use std::fmt::Display;
+
+use crate::private::MarkSelected;
+use crate::AwShuffler;
+
+/// How a [`Mirrored`] shuffler handles errors from its secondary shuffler.
+#[derive(Debug, Clone, Copy)]
+pub enum MirrorPolicy {
+    /// Return errors from the secondary shuffler to the caller. The primary shuffler has already
+    /// been updated when this happens.
+    Propagate,
+    /// Stop mirroring to the secondary shuffler after its first error and keep using the primary
+    /// shuffler alone. The error is available from [`Mirrored::secondary_error`].
+    Detach,
+}
+
+/// An error from one of the shufflers in a [`Mirrored`] shuffler.
+#[derive(Debug)]
+pub enum MirrorError<P, S> {
+    /// An error from the primary shuffler.
+    Primary(P),
+    /// An error from the secondary shuffler.
+    Secondary(S),
+}
+
+impl<P: Display, S: Display> Display for MirrorError<P, S> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Primary(e) => e.fmt(f),
+            Self::Secondary(e) => write!(f, "secondary shuffler: {e}"),
+        }
+    }
+}
+
+impl<P: Error + 'static, S: Error + 'static> Error for MirrorError<P, S> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        Some(match self {
+            Self::Primary(e) => e,
+            Self::Secondary(e) => e,
+        })
+    }
+}
+
+/// A shuffler that applies every change made to its primary shuffler to a secondary shuffler as
+/// well, such as a second [`PersistentShuffler`](crate::persistent::PersistentShuffler) acting as
+/// a live backup.
+///
+/// All selections are made by the primary shuffler, and the selected items are marked as
+/// selected in the secondary shuffler. Both shufflers should start out containing the same items
+/// for the secondary to remain a faithful copy.
+#[derive(Debug)]
+pub struct Mirrored<P: AwShuffler, S: AwShuffler<Item = P::Item>> {
+    primary: P,
+    secondary: Option<S>,
+    secondary_error: Option<S::Error>,
+    policy: MirrorPolicy,
+}
+
+impl<P, S> Mirrored<P, S>
+where
+    P: AwShuffler,
+    S: AwShuffler<Item = P::Item> + MarkSelected,
+{
+    /// Creates a new Mirrored shuffler from a primary and secondary shuffler.
+    pub const fn new(primary: P, secondary: S, policy: MirrorPolicy) -> Self {
+        Self {
+            primary,
+            secondary: Some(secondary),
+            secondary_error: None,
+            policy,
+        }
+    }
+
+    /// Returns the primary shuffler.
+    pub const fn primary(&self) -> &P {
+        &self.primary
+    }
+
+    /// Returns the secondary shuffler, unless it has been detached after an error.
+    pub const fn secondary(&self) -> Option<&S> {
+        self.secondary.as_ref()
+    }
+
+    /// Returns the error that caused the secondary shuffler to be detached, if any.
+    pub const fn secondary_error(&self) -> Option<&S::Error> {
+        self.secondary_error.as_ref()
+    }
+
+    /// Consumes the Mirrored shuffler and returns both shufflers. The secondary shuffler is `None`
+    /// if it was detached.
+    pub fn into_inner(self) -> (P, Option<S>) {
+        (self.primary, self.secondary)
+    }
+
+    fn mirror<O>(
+        secondary: &mut Option<S>,
+        secondary_error: &mut Option<S::Error>,
+        policy: MirrorPolicy,
+        op: impl FnOnce(&mut S) -> Result<O, S::Error>,
+    ) -> Result<(), MirrorError<P::Error, S::Error>> {
+        let Some(s) = secondary else {
+            return Ok(());
+        };
+
+        match (op(s), policy) {
+            (Ok(_), _) => Ok(()),
+            (Err(e), MirrorPolicy::Propagate) => Err(MirrorError::Secondary(e)),
+            (Err(e), MirrorPolicy::Detach) => {
+                *secondary = None;
+                *secondary_error = Some(e);
+                Ok(())
+            }
+        }
+    }
+}
+
+impl<P, S> AwShuffler for Mirrored<P, S>
+where
+    P: AwShuffler,
+    S: AwShuffler<Item = P::Item> + MarkSelected,
+    P::Item: Clone,
+    P::Error: 'static,
+    S::Error: 'static,
+{
+    type Error = MirrorError<P::Error, S::Error>;
+    type Item = P::Item;
+
+    fn add(&mut self, item: Self::Item) -> Result<bool, Self::Error> {
+        let added = self.primary.add(item.clone()).map_err(MirrorError::Primary)?;
+        Self::mirror(&mut self.secondary, &mut self.secondary_error, self.policy, |s| s.add(item))?;
+        Ok(added)
+    }
+
+    fn remove(&mut self, item: &Self::Item) -> Result<Option<Self::Item>, Self::Error> {
+        let removed = self.primary.remove(item).map_err(MirrorError::Primary)?;
+        Self::mirror(&mut self.secondary, &mut self.secondary_error, self.policy, |s| {
+            s.remove(item)
+        })?;
+        Ok(removed)
+    }
+
+    fn next(&mut self) -> Result<Option<&Self::Item>, Self::Error> {
+        let next = self.primary.next().map_err(MirrorError::Primary)?;
+        if let Some(next) = next {
+            Self::mirror(&mut self.secondary, &mut self.secondary_error, self.policy, |s| {
+                s.mark_selected(&[next])
+            })?;
+        }
+        Ok(next)
+    }
+
+    fn next_n(&mut self, n: usize) -> Result<Option<Vec<&Self::Item>>, Self::Error> {
+        let next = self.primary.next_n(n).map_err(MirrorError::Primary)?;
+        if let Some(next) = &next {
+            Self::mirror(&mut self.secondary, &mut self.secondary_error, self.policy, |s| {
+                s.mark_selected(next)
+            })?;
+        }
+        Ok(next)
+    }
+
+    fn unique_n(&mut self, n: usize) -> Result<Option<Vec<&Self::Item>>, Self::Error> {
+        let next = self.primary.unique_n(n).map_err(MirrorError::Primary)?;
+        if let Some(next) = &next {
+            Self::mirror(&mut self.secondary, &mut self.secondary_error, self.policy, |s| {
+                s.mark_selected(next)
+            })?;
+        }
+        Ok(next)
+    }
+
+    fn size(&self) -> usize {
+        self.primary.size()
+    }
+
+    fn contains(&self, item: &Self::Item) -> bool {
+        self.primary.contains(item)
+    }
+
+    fn values(&self) -> Vec<&Self::Item> {
+        self.primary.values()
+    }
+
+    fn into_values(self) -> Vec<Self::Item> {
+        self.primary.into_values()
+    }
+
+    fn dump(&self) -> Vec<(&Self::Item, u64)> {
+        self.primary.dump()
+    }
+}
+
+impl<P, S> crate::private::Sealed for Mirrored<P, S>
+where
+    P: AwShuffler,
+    S: AwShuffler<Item = P::Item>,
+{
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{NewItemHandling, Shuffler};
+
+    #[test]
+    fn mirrors() {
+        let mut m = Mirrored::new(
+            Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1),
+            Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 2),
+            MirrorPolicy::Propagate,
+        );
+
+        for i in 0..10 {
+            m.add(i).unwrap();
+        }
+        m.remove(&3).unwrap();
+        for _ in 0..5 {
+            m.next().unwrap();
+            m.unique_n(3).unwrap();
+        }
+
+        let (primary, secondary) = m.into_inner();
+        let secondary = secondary.unwrap();
+
+        let mut expected = primary.dump();
+        expected.sort_unstable();
+        let mut mirrored = secondary.dump();
+        mirrored.sort_unstable();
+        assert_eq!(expected, mirrored);
+        assert!(!secondary.contains(&3));
+    }
+}
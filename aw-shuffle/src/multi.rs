@@ -0,0 +1,236 @@
+use rand::prelude::{SliceRandom, StdRng};
+use rand::{Rng, SeedableRng};
+
+use crate::AwShuffler;
+
+/// Combines several shufflers of the same type, routing selections between them in proportion to
+/// their weights. Selected items are returned along with the index of the shuffler they came from.
+///
+/// Each underlying shuffler still tracks its own items and how recently they were selected, so
+/// this can be used to build a composite collection without merging the shufflers themselves.
+#[derive(Debug)]
+pub struct MultiShuffler<S: AwShuffler> {
+    shufflers: Vec<(S, f64)>,
+    rng: StdRng,
+}
+
+#[allow(clippy::type_complexity)]
+impl<S: AwShuffler> MultiShuffler<S> {
+    /// Creates a new MultiShuffler from a list of shufflers and their weights.
+    ///
+    /// Shufflers with a weight of 0 will never be selected from. Empty shufflers are skipped.
+    ///
+    /// # Panics
+    /// Panics if any weight is negative, infinite, or NaN, or if the weights add up to infinity.
+    #[must_use]
+    pub fn new(shufflers: Vec<(S, f64)>) -> Self {
+        Self::new_with_rng(shufflers, StdRng::from_entropy())
+    }
+
+    /// Creates a new MultiShuffler like [`new`](Self::new), but with its random number generator
+    /// initialized from `seed`.
+    ///
+    /// This only controls how selections are routed between shufflers, not how the underlying
+    /// shufflers select their items.
+    ///
+    /// # Panics
+    /// Panics if any weight is negative, infinite, or NaN, or if the weights add up to infinity.
+    #[must_use]
+    pub fn new_seeded(shufflers: Vec<(S, f64)>, seed: u64) -> Self {
+        Self::new_with_rng(shufflers, StdRng::seed_from_u64(seed))
+    }
+
+    fn new_with_rng(shufflers: Vec<(S, f64)>, rng: StdRng) -> Self {
+        for (_, w) in &shufflers {
+            assert!(w.is_finite(), "weight {w} must be finite.");
+            assert!(w.is_sign_positive(), "weight {w} cannot be negative.");
+        }
+        // Selection draws from the range between 0 and the total, which must be finite.
+        let total: f64 = shufflers.iter().map(|(_, w)| w).sum();
+        assert!(total.is_finite(), "weights must add up to a finite total, not {total}.");
+
+        Self { shufflers, rng }
+    }
+
+    /// Returns the next item from one of the shufflers, along with the index of that shuffler.
+    ///
+    /// Returns `Ok(None)` when every shuffler with a non-zero weight is empty.
+    #[allow(clippy::should_implement_trait)]
+    pub fn next(&mut self) -> Result<Option<(usize, &S::Item)>, S::Error> {
+        let weights: Vec<_> =
+            self.shufflers.iter().map(|(s, w)| if s.size() == 0 { 0.0 } else { *w }).collect();
+
+        let Some(i) = weighted_index(&weights, &mut self.rng) else {
+            return Ok(None);
+        };
+
+        Ok(self.shufflers[i].0.next()?.map(|item| (i, item)))
+    }
+
+    /// Returns the next `n` items, divided between the shufflers in proportion to their weights.
+    /// Each shuffler handles its share as in [`AwShuffler::next_n`].
+    ///
+    /// Returns `Ok(None)` when every shuffler with a non-zero weight is empty, even if `n` is 0.
+    pub fn next_n(&mut self, n: usize) -> Result<Option<Vec<(usize, &S::Item)>>, S::Error> {
+        let weights: Vec<_> =
+            self.shufflers.iter().map(|(s, w)| if s.size() == 0 { 0.0 } else { *w }).collect();
+
+        if weighted_index(&weights, &mut self.rng).is_none() {
+            return Ok(None);
+        }
+
+        let mut counts = vec![0; weights.len()];
+        for _ in 0..n {
+            // Already checked that at least one weight is positive.
+            counts[weighted_index(&weights, &mut self.rng).unwrap()] += 1;
+        }
+
+        self.collect(counts, |s, n| s.next_n(n))
+    }
+
+    /// Returns the next `n` items, divided between the shufflers in proportion to their weights.
+    /// Items are guaranteed to be unique within each shuffler, and no shuffler will be asked for
+    /// more items than it contains.
+    ///
+    /// Returns `Ok(None)` when the shufflers with non-zero weights do not contain enough items to
+    /// fulfill the request or when they are all empty, even if `n` is 0.
+    pub fn unique_n(&mut self, n: usize) -> Result<Option<Vec<(usize, &S::Item)>>, S::Error> {
+        let mut remaining: Vec<_> =
+            self.shufflers.iter().map(|(s, w)| if *w > 0.0 { s.size() } else { 0 }).collect();
+
+        let available: usize = remaining.iter().sum();
+        if available == 0 || available < n {
+            return Ok(None);
+        }
+
+        let mut counts = vec![0; remaining.len()];
+        for _ in 0..n {
+            let weights: Vec<_> = self
+                .shufflers
+                .iter()
+                .zip(&remaining)
+                .map(|((_, w), r)| if *r == 0 { 0.0 } else { *w })
+                .collect();
+
+            // There are always enough items left.
+            let i = weighted_index(&weights, &mut self.rng).unwrap();
+            counts[i] += 1;
+            remaining[i] -= 1;
+        }
+
+        self.collect(counts, |s, n| s.unique_n(n))
+    }
+
+    /// Returns the total number of items in all shufflers.
+    pub fn size(&self) -> usize {
+        self.shufflers.iter().map(|(s, _)| s.size()).sum()
+    }
+
+    /// Returns a reference to the shuffler at `index`, if it exists.
+    pub fn get(&self, index: usize) -> Option<&S> {
+        self.shufflers.get(index).map(|(s, _)| s)
+    }
+
+    /// Returns a mutable reference to the shuffler at `index`, if it exists. This can be used to
+    /// add or remove items.
+    pub fn get_mut(&mut self, index: usize) -> Option<&mut S> {
+        self.shufflers.get_mut(index).map(|(s, _)| s)
+    }
+
+    /// Consumes the MultiShuffler and returns the underlying shufflers and their weights.
+    pub fn into_inner(self) -> Vec<(S, f64)> {
+        self.shufflers
+    }
+
+    fn collect<'a>(
+        &'a mut self,
+        counts: Vec<usize>,
+        mut select: impl FnMut(&'a mut S, usize) -> Result<Option<Vec<&'a S::Item>>, S::Error>,
+    ) -> Result<Option<Vec<(usize, &'a S::Item)>>, S::Error> {
+        let mut output = Vec::with_capacity(counts.iter().sum());
+
+        for (i, ((s, _), n)) in self.shufflers.iter_mut().zip(counts).enumerate() {
+            if n == 0 {
+                continue;
+            }
+
+            // Every shuffler with a non-zero count has enough items.
+            let selected = select(s, n)?.unwrap_or_default();
+            output.extend(selected.into_iter().map(|item| (i, item)));
+        }
+
+        // Don't leak which shuffler items came from through their order.
+        output.shuffle(&mut self.rng);
+        Ok(Some(output))
+    }
+}
+
+fn weighted_index<R: Rng>(weights: &[f64], rng: &mut R) -> Option<usize> {
+    let total: f64 = weights.iter().sum();
+    if total <= 0.0 {
+        return None;
+    }
+
+    let mut r = rng.gen_range(0.0..total);
+    for (i, w) in weights.iter().enumerate() {
+        if r < *w {
+            return Some(i);
+        }
+        r -= w;
+    }
+
+    // Floating point error can leave a tiny remainder, so fall back to the last eligible index.
+    weights.iter().rposition(|w| *w > 0.0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{InfallibleShuffler, NewItemHandling, Shuffler};
+
+    fn shuffler(items: &[&'static str]) -> Shuffler<&'static str> {
+        let mut s = Shuffler::new_seeded(2.0, NewItemHandling::NeverSelected, 1);
+        for &item in items {
+            s.inf_add(item);
+        }
+        s
+    }
+
+    #[test]
+    fn empty() {
+        let mut m =
+            MultiShuffler::new_seeded(vec![(shuffler(&[]), 1.0), (shuffler(&["a"]), 0.0)], 1);
+
+        assert_eq!(m.next().unwrap(), None);
+        assert_eq!(m.next_n(0).unwrap(), None);
+        assert_eq!(m.unique_n(0).unwrap(), None);
+        assert_eq!(m.size(), 1);
+    }
+
+    #[test]
+    fn attribution() {
+        let mut m = MultiShuffler::new_seeded(
+            vec![(shuffler(&["a", "b"]), 1.0), (shuffler(&["c"]), 1.0)],
+            1,
+        );
+
+        for _ in 0..10 {
+            let (i, item) = m.next().unwrap().unwrap();
+            assert_eq!(i, usize::from(*item == "c"));
+        }
+
+        let mut picked: Vec<_> = m.unique_n(3).unwrap().unwrap();
+        picked.sort_unstable();
+        assert_eq!(picked, vec![(0, &"a"), (0, &"b"), (1, &"c")]);
+        assert_eq!(m.unique_n(4).unwrap(), None);
+
+        assert_eq!(m.next_n(20).unwrap().unwrap().len(), 20);
+    }
+
+    #[test]
+    #[should_panic(expected = "finite total")]
+    fn overflowing_weights() {
+        let shufflers = vec![(shuffler(&["a"]), f64::MAX), (shuffler(&["b"]), f64::MAX)];
+        let _ = MultiShuffler::new(shufflers);
+    }
+}
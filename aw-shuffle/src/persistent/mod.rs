@@ -1,5 +1,7 @@
 //! Module containing shufflers that are backed by a persistent database.
 
+use std::time::Duration;
+
 use serde::de::DeserializeOwned;
 use serde::Serialize;
 
@@ -83,6 +85,9 @@ where
     /// using [`remove`](AwShuffler::remove) alone, it will need to be added then removed, or
     /// cleared by a future shuffler initialized with [`Options::keep_unrecognized`] set to
     /// `true`.
+    ///
+    /// With [`Options::persist_soft_removes`] set the removal is also recorded so future shufflers
+    /// won't load the item until it is loaded or added again.
     fn soft_remove(&mut self, item: &Self::Item) -> Result<Option<Self::Item>, Self::Error>;
 
 
@@ -114,26 +119,70 @@ where
     fn close_leak(self) -> Result<(), Self::Error>;
 }
 
-/// Options for initializing a [`PersistentShuffler`].
-pub struct Options {
+/// Options for initializing a [`PersistentShuffler`] of items of type `T`.
+pub struct Options<T> {
     bias: f64,
     new_item_handling: NewItemHandling,
     remove_on_deserialization_error: bool,
     keep_unrecognized: bool,
+    seed: Option<u64>,
+    retries: u32,
+    retry_backoff: Duration,
+    read_only_fallback: bool,
+    persist_soft_removes: bool,
+    include_soft_removed: bool,
+    progress: Option<Box<dyn FnMut(usize, usize) + Send>>,
+    validator: Option<Validator<T>>,
 }
 
-impl Default for Options {
+// Closures aren't Debug, so the validator is only named in debug output.
+#[cfg_attr(not(feature = "rocks"), allow(dead_code))]
+struct Validator<T>(Box<dyn Fn(T) -> Result<T, String> + Send + Sync>);
+
+impl<T> std::fmt::Debug for Validator<T> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("Validator")
+    }
+}
+
+impl<T> Default for Options<T> {
     fn default() -> Self {
         Self {
             bias: 2.0,
             new_item_handling: NewItemHandling::NeverSelected,
             remove_on_deserialization_error: false,
             keep_unrecognized: false,
+            seed: None,
+            retries: 0,
+            retry_backoff: Duration::ZERO,
+            read_only_fallback: false,
+            persist_soft_removes: false,
+            include_soft_removed: false,
+            progress: None,
+            validator: None,
         }
     }
 }
 
-impl Options {
+impl<T> std::fmt::Debug for Options<T> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Options")
+            .field("bias", &self.bias)
+            .field("new_item_handling", &self.new_item_handling)
+            .field("remove_on_deserialization_error", &self.remove_on_deserialization_error)
+            .field("keep_unrecognized", &self.keep_unrecognized)
+            .field("seed", &self.seed)
+            .field("retries", &self.retries)
+            .field("retry_backoff", &self.retry_backoff)
+            .field("read_only_fallback", &self.read_only_fallback)
+            .field("persist_soft_removes", &self.persist_soft_removes)
+            .field("include_soft_removed", &self.include_soft_removed)
+            .field("validator", &self.validator)
+            .finish_non_exhaustive()
+    }
+}
+
+impl<T> Options<T> {
     /// Controls how strongly the shuffler is biased towards older items. See
     /// [`Shuffler::new`](crate::Shuffler::new).
     ///
@@ -184,4 +233,112 @@ impl Options {
         self.keep_unrecognized = keep_unrecognized;
         self
     }
+
+    /// Seeds the shuffler's random number generator and hasher so results are reproducible. See
+    /// [`Shuffler::new_seeded`](crate::Shuffler::new_seeded).
+    ///
+    /// By default the shuffler is seeded randomly.
+    #[must_use]
+    pub const fn seed(mut self, seed: u64) -> Self {
+        self.seed = Some(seed);
+        self
+    }
+
+    /// Retries writes that fail because the database was busy, timed out, or asked to be retried,
+    /// up to `retries` times. The delay before each retry starts at `backoff` and doubles after
+    /// every attempt. Writes only set or remove items, so repeating them is always safe.
+    ///
+    /// Reads are never retried, and neither are other errors, including I/O errors, since those are
+    /// usually a full disk or a missing file that won't go away on their own. By default writes are
+    /// not retried.
+    #[must_use]
+    pub const fn retries(mut self, retries: u32, backoff: Duration) -> Self {
+        self.retries = retries;
+        self.retry_backoff = backoff;
+        self
+    }
+
+    /// Controls whether a database that can't be opened for writing, such as one on a read-only
+    /// filesystem, is opened read-only instead of returning an error.
+    ///
+    /// The default value is `false`.
+    ///
+    /// A read-only shuffler loads the existing items and generations and works normally, but
+    /// changes are only kept in memory and are lost when it is dropped. Use
+    /// [`is_read_only`](rocksdb::Shuffler::is_read_only) to report that persistence is disabled.
+    #[must_use]
+    pub const fn read_only_fallback(mut self, read_only_fallback: bool) -> Self {
+        self.read_only_fallback = read_only_fallback;
+        self
+    }
+
+    /// Controls whether [`soft_remove`](PersistentShuffler::soft_remove) is recorded in the
+    /// database, so that future shufflers don't load soft removed items even when they're in
+    /// the [`items`](rocksdb::Shuffler::new) vector. They stay hidden until they are loaded or
+    /// added again.
+    ///
+    /// The default value is `false`. Once recorded, soft removes are respected regardless of this
+    /// setting.
+    #[must_use]
+    pub const fn persist_soft_removes(mut self, persist_soft_removes: bool) -> Self {
+        self.persist_soft_removes = persist_soft_removes;
+        self
+    }
+
+    /// Controls whether items recorded as soft removed because of
+    /// [`persist_soft_removes`](Self::persist_soft_removes) are loaded anyway.
+    ///
+    /// The default value is `false`. The records are kept either way.
+    #[must_use]
+    pub const fn include_soft_removed(mut self, include_soft_removed: bool) -> Self {
+        self.include_soft_removed = include_soft_removed;
+        self
+    }
+
+    /// Calls `progress` periodically while loading the database with the number of items read so
+    /// far and an estimate of the total, so applications can show progress when loading very
+    /// large databases. It is called once more with both numbers equal when loading finishes.
+    ///
+    /// The total is RocksDB's estimate of the number of keys and is never less than the number
+    /// read, but it may be too high.
+    #[must_use]
+    pub fn load_progress(mut self, progress: impl FnMut(usize, usize) + Send + 'static) -> Self {
+        self.progress = Some(Box::new(progress));
+        self
+    }
+
+    /// Sets a function that checks and normalizes items, returning the item to use in its place
+    /// or a description of the problem. The validator is not stored in the database.
+    ///
+    /// Items passed to [`Shuffler::new`](rocksdb::Shuffler::new) are replaced with their
+    /// normalized forms, and items in the database that the validator rejects or would change are
+    /// treated like ones that can't be deserialized. Both cause
+    /// [`Error::Invalid`](rocksdb::Error::Invalid) unless
+    /// [`remove_on_deserialization_error`](Self::remove_on_deserialization_error) is set, in which
+    /// case they are skipped or removed from the database.
+    ///
+    /// Items added or loaded later are normalized the same way, and rejected ones return
+    /// [`Error::Invalid`](rocksdb::Error::Invalid) without anything being written.
+    /// [`FallbackShuffler`](rocksdb::FallbackShuffler) only checks items while opening the
+    /// database.
+    #[must_use]
+    pub fn validator(
+        mut self,
+        validator: impl Fn(T) -> Result<T, String> + Send + Sync + 'static,
+    ) -> Self {
+        self.validator = Some(Validator(Box::new(validator)));
+        self
+    }
+
+    // The in-memory shuffler a persistent shuffler with these options is built on.
+    #[cfg_attr(not(feature = "rocks"), allow(dead_code))]
+    fn in_memory(&self) -> crate::Shuffler<T>
+    where
+        T: crate::Item,
+    {
+        match self.seed {
+            Some(seed) => crate::Shuffler::new_seeded(self.bias, self.new_item_handling, seed),
+            None => crate::Shuffler::new(self.bias, self.new_item_handling),
+        }
+    }
 }
@@ -1,27 +1,50 @@
 //! Module containing the [`PersistentShuffler`] backed by RocksDB.
+//!
+//! Recovery from bad entries, generation resets, and slow database operations are reported
+//! through the [`log`] crate.
 
+use std::convert::Infallible;
 use std::fmt::Display;
 use std::hash::Hasher;
+use std::marker::PhantomData;
 use std::mem::ManuallyDrop;
 use std::path::Path;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, Instant};
 
-use ahash::{AHashSet, AHasher};
+use ahash::{AHashMap, AHashSet, AHasher};
+use log::{debug, warn};
 use rand::prelude::StdRng;
 use rand::Rng;
 use rmp_serde::{decode, encode, Deserializer};
 use rocksdb::IteratorMode::Start;
-use rocksdb::{WriteBatch, DB};
+use rocksdb::{ColumnFamily, ErrorKind, WriteBatch, DB};
 use serde::Deserialize;
 
-use super::{Item, Options, PersistentShuffler};
-use crate::{AwShuffler, InfallibleShuffler, ShufflerGeneric as BaseShuffler};
+use super::{Item, Options, PersistentShuffler, Validator};
+use crate::rbtree::Node;
+use crate::{
+    AwShuffler, BiasSchedule, InfallibleShuffler, Settings, ShufflerGeneric as BaseShuffler,
+};
 
+// Database operations slower than this are logged as warnings.
+const SLOW_OPERATION: Duration = Duration::from_secs(1);
+// How many keys are read between calls to the progress callback while loading.
+const PROGRESS_INTERVAL: usize = 10_000;
+// The column family holding the keys of soft removed items, with empty values.
+const SOFT_REMOVED: &str = "soft_removed";
 
 /// A simple wrapper around the different sources of errors that can happen.
 ///
 /// Once an error is returned the state of the in-memory shuffler is no longer guaranteed to be
-/// in sync with the database and it should no longer be used.
+/// in sync with the database and it should no longer be used. The exceptions are
+/// [`Error::Invalid`] and [`Error::Cancelled`], which are returned before anything is changed.
+///
+/// More variants may be added in the future, so matches need a wildcard arm.
 #[derive(Debug)]
+#[non_exhaustive]
 pub enum Error {
     /// An error during serialization when attempting to insert a key into the database.
     Serialization(encode::Error),
@@ -32,6 +55,10 @@ pub enum Error {
     Deserialization(decode::Error),
     /// An error from a database operation.
     DB(rocksdb::Error),
+    /// An item was rejected by the validator set with [`Options::validator`].
+    Invalid(String),
+    /// Loading was cancelled by [`Shuffler::new_cancellable`] before the shuffler was created.
+    Cancelled,
 }
 
 impl From<encode::Error> for Error {
@@ -58,17 +85,20 @@ impl Display for Error {
             Self::Serialization(e) => e.fmt(f),
             Self::Deserialization(e) => e.fmt(f),
             Self::DB(e) => e.fmt(f),
+            Self::Invalid(msg) => write!(f, "invalid item: {msg}"),
+            Self::Cancelled => f.write_str("loading was cancelled"),
         }
     }
 }
 
 impl std::error::Error for Error {
     fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
-        Some(match self {
-            Self::Serialization(e) => e,
-            Self::Deserialization(e) => e,
-            Self::DB(e) => e,
-        })
+        match self {
+            Self::Serialization(e) => Some(e),
+            Self::Deserialization(e) => Some(e),
+            Self::DB(e) => Some(e),
+            Self::Invalid(_) | Self::Cancelled => None,
+        }
     }
 }
 
@@ -78,11 +108,72 @@ impl std::error::Error for Error {
 #[derive(Debug)]
 pub struct ShufflerGeneric<T: Item, H: Hasher + Clone, R: Rng> {
     internal: ManuallyDrop<BaseShuffler<T, H, R>>,
-    db: DB,
+    // Shared with any readers.
+    db: Arc<DB>,
+    // Reused when writing single items so steady state calls to next() don't allocate.
+    key_buf: Vec<u8>,
+    removed_on_load: usize,
+    unrecognized: Vec<T>,
+    persist_soft_removes: bool,
+    writes: Writes,
+    validator: Option<Validator<T>>,
     closed: bool,
     leak: bool,
 }
 
+#[derive(Debug, Clone, Copy)]
+struct Writes {
+    // The database was opened read-only, so writes are skipped and changes only live in memory.
+    read_only: bool,
+    attempts: u32,
+    backoff: Duration,
+}
+
+impl Writes {
+    // Runs a database write, repeating it if it fails in a way that might not happen again.
+    fn run(self, mut write: impl FnMut() -> Result<(), Error>) -> Result<(), Error> {
+        if self.read_only {
+            return Ok(());
+        }
+
+        let mut backoff = self.backoff;
+
+        for attempt in 1..=self.attempts {
+            match write() {
+                Err(Error::DB(e)) if transient(&e) => {
+                    warn!("Retrying database write ({attempt}/{}) after error: {e}", self.attempts);
+                    thread::sleep(backoff);
+                    backoff = backoff.saturating_mul(2);
+                }
+                r => return r,
+            }
+        }
+        write()
+    }
+}
+
+fn transient(e: &rocksdb::Error) -> bool {
+    matches!(e.kind(), ErrorKind::Busy | ErrorKind::TimedOut | ErrorKind::TryAgain)
+}
+
+/// An item as stored in the database, returned by [`ShufflerGeneric::dump_database`] and
+/// [`Reader::dump`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Record<T> {
+    /// The stored item.
+    pub item: T,
+    /// The generation the item was last selected in.
+    pub generation: u64,
+    /// Whether the item is recorded as soft removed because of
+    /// [`Options::persist_soft_removes`].
+    pub soft_removed: bool,
+}
+
+// The number of entries removed while loading and the unrecognized items among them.
+type Removed<T> = (usize, Vec<T>);
+// The index of each item that wasn't in the database and the generation it was given.
+type Added = Vec<(usize, u64)>;
+
 /// Type alias for [`ShufflerGeneric`] with the default hasher and rng implementations.
 pub type Shuffler<T> = ShufflerGeneric<T, AHasher, StdRng>;
 
@@ -94,36 +185,44 @@ where
     R: Rng,
 {
     fn load(&mut self, item: Self::Item) -> Result<bool, Self::Error> {
+        let item = self.validate(item)?;
         if self.internal.tree.find_node(&item).is_some() {
             return Ok(false);
         }
 
         match self.get(&item)? {
-            Some(gen) => Ok(self.internal.tree.insert(item, gen)),
+            Some(gen) => {
+                self.set_soft_removed(&item, false)?;
+                Ok(self.internal.tree.insert(item, gen))
+            }
             None => self.add(item),
         }
     }
 
     fn soft_remove(&mut self, item: &Self::Item) -> Result<Option<Self::Item>, Self::Error> {
-        Ok(self.internal.inf_remove(item))
+        let removed = self.internal.inf_remove(item);
+        if removed.is_some() && self.persist_soft_removes {
+            self.set_soft_removed(item, true)?;
+        }
+        Ok(removed)
     }
 
     fn compact(&mut self) -> Result<(), Self::Error> {
+        if self.writes.read_only {
+            return Ok(());
+        }
         self.db.compact_range::<&[u8], &[u8]>(None, None);
         self.db.flush().map_err(Into::into)
     }
 
     fn close(mut self) -> Result<(), Self::Error> {
         self.closed = true;
-        self.db.flush()?;
-        self.db.cancel_all_background_work(true);
-        Ok(())
+        self.shutdown()
     }
 
     fn close_into_values(mut self) -> Result<Vec<Self::Item>, Self::Error> {
         self.closed = true;
-        self.db.flush()?;
-        self.db.cancel_all_background_work(true);
+        self.shutdown()?;
         Ok(self.into_values())
     }
 
@@ -143,9 +242,10 @@ where
     type Item = T;
 
     fn add(&mut self, item: Self::Item) -> Result<bool, Self::Error> {
+        let item = self.validate(item)?;
         let gen = self.internal.add_generation();
 
-        Self::put_batch(&self.db, &[&item], gen)?;
+        Self::put_added(&self.db, self.writes, &item, gen)?;
         Ok(self.internal.tree.insert(item, gen))
     }
 
@@ -165,7 +265,7 @@ where
 
         let next = self.internal.inf_next();
         if let Some(next) = next {
-            Self::put_batch(&self.db, &[next], gen.get())?;
+            Self::put_one(&self.db, self.writes, &mut self.key_buf, next, gen.get())?;
         }
         Ok(next)
     }
@@ -178,7 +278,7 @@ where
 
         let next = self.internal.inf_next_n(n);
         if let Some(next) = &next {
-            Self::put_batch(&self.db, next, gen.get())?;
+            Self::put_batch(&self.db, self.writes, next, gen.get())?;
         }
         Ok(next)
     }
@@ -191,7 +291,7 @@ where
 
         let next = self.internal.inf_unique_n(n);
         if let Some(next) = &next {
-            Self::put_batch(&self.db, next, gen.get())?;
+            Self::put_batch(&self.db, self.writes, next, gen.get())?;
         }
         Ok(next)
     }
@@ -200,6 +300,10 @@ where
         self.internal.size()
     }
 
+    fn contains(&self, item: &Self::Item) -> bool {
+        self.internal.contains(item)
+    }
+
     fn values(&self) -> Vec<&Self::Item> {
         self.internal.values()
     }
@@ -224,7 +328,7 @@ where
     R: Rng,
 {
     fn drop(&mut self) {
-        if !self.closed {
+        if !self.closed && !self.writes.read_only {
             drop(self.db.flush());
             self.db.cancel_all_background_work(false);
         }
@@ -245,6 +349,268 @@ where
     H: Hasher + Clone,
     R: Rng,
 {
+    /// Returns a [`Reader`] sharing this shuffler's database, for reading it from other threads
+    /// while the shuffler keeps writing.
+    pub fn reader(&self) -> Reader<T> {
+        Reader { db: self.db.clone(), _item: PhantomData }
+    }
+
+    /// Returns an iterator over the items currently loaded in memory. See
+    /// [`crate::ShufflerGeneric::iter`].
+    pub fn iter(&self) -> impl ExactSizeIterator<Item = &T> + '_ {
+        self.internal.iter()
+    }
+
+    /// Returns a page of the items currently loaded in memory. See
+    /// [`crate::ShufflerGeneric::values_page`].
+    pub fn values_page(&self, after: Option<&T>, limit: usize) -> Vec<&T> {
+        self.internal.values_page(after, limit)
+    }
+
+    /// Returns the matching items currently loaded in memory. See
+    /// [`crate::ShufflerGeneric::values_where`].
+    pub fn values_where(&self, pred: impl FnMut(&T) -> bool) -> Vec<&T> {
+        self.internal.values_where(pred)
+    }
+
+    /// Returns the items currently loaded in memory starting with `prefix`. See
+    /// [`crate::ShufflerGeneric::values_with_prefix`].
+    pub fn values_with_prefix(&self, prefix: &str) -> Vec<&T>
+    where
+        T: AsRef<str>,
+    {
+        self.internal.values_with_prefix(prefix)
+    }
+
+    /// Counts the items loaded in memory by generation. See
+    /// [`crate::ShufflerGeneric::generation_histogram`].
+    pub fn generation_histogram(&self, buckets: usize) -> Vec<(u64, usize)> {
+        self.internal.generation_histogram(buckets)
+    }
+
+    /// Writes the settings and contents of the in-memory shuffler. See
+    /// [`crate::ShufflerGeneric::write_debug`].
+    pub fn write_debug(&self, f: &mut impl std::fmt::Write) -> std::fmt::Result
+    where
+        T: std::fmt::Debug,
+    {
+        self.internal.write_debug(f)
+    }
+
+    /// See [`crate::ShufflerGeneric::debug_string`].
+    pub fn debug_string(&self) -> String
+    where
+        T: std::fmt::Debug,
+    {
+        self.internal.debug_string()
+    }
+
+    /// Selects a run of items that follow each other, from those currently loaded in memory. See
+    /// [`crate::ShufflerGeneric::next_run`].
+    pub fn next_run(&mut self, k: usize) -> Result<Option<Vec<&T>>, Error> {
+        let (gen, reset) = self.internal.next_generation();
+        if reset {
+            self.handle_reset()?;
+        }
+
+        let run = self.internal.next_run(k);
+        if let Some(run) = &run {
+            Self::put_batch(&self.db, self.writes, run, gen.get())?;
+        }
+        Ok(run)
+    }
+
+    /// Removes every item matching `pred` from both the shuffler and the database in a single
+    /// batch, and returns them. See [`crate::ShufflerGeneric::remove_where`].
+    ///
+    /// Items kept in the database with [`Options::keep_unrecognized`] that aren't loaded are not
+    /// checked.
+    pub fn remove_where(&mut self, pred: impl FnMut(&T, u64) -> bool) -> Result<Vec<T>, Error> {
+        let removed = self.internal.remove_where(pred);
+        if !removed.is_empty() {
+            let keys = removed.iter().map(encode::to_vec).collect::<Result<Vec<_>, _>>()?;
+            Self::delete_keys(&self.db, self.writes, &keys)?;
+        }
+        Ok(removed)
+    }
+
+    /// Lists the items recorded as soft removed because of [`Options::persist_soft_removes`], in
+    /// no specific order. Items loaded anyway because of [`Options::include_soft_removed`] are
+    /// included.
+    pub fn soft_removed(&self) -> Result<Vec<T>, Error> {
+        let Some(hidden) = self.db.cf_handle(SOFT_REMOVED) else {
+            return Ok(Vec::new());
+        };
+
+        let mut items = Vec::new();
+        for r in self.db.iterator_cf(hidden, Start) {
+            let (key, _) = r?;
+            items.push(T::deserialize(&mut Deserializer::new(&*key))?);
+        }
+        Ok(items)
+    }
+
+    /// Reads every item stored in the database, including ones that aren't loaded in memory
+    /// because they were soft removed or kept with [`Options::keep_unrecognized`], so the
+    /// complete on-disk state can be audited. Records are returned in no specific order.
+    ///
+    /// Unlike [`dump`](AwShuffler::dump) this reads the entire database. Nothing else is stored;
+    /// settings such as the bias only exist in memory.
+    pub fn dump_database(&self) -> Result<Vec<Record<T>>, Error> {
+        self.reader().dump()
+    }
+
+    /// Loads each of `items` that is recorded as soft removed, as if by calling
+    /// [`load`](PersistentShuffler::load), clearing the record. Other items are ignored.
+    ///
+    /// Returns the number of items that were restored.
+    pub fn restore_soft_removed(&mut self, items: Vec<T>) -> Result<usize, Error> {
+        let mut restored = 0;
+        for item in items {
+            if !self.is_soft_removed(&item)? {
+                continue;
+            }
+
+            // Items loaded because of include_soft_removed only need the record cleared.
+            if self.internal.contains(&item) {
+                self.set_soft_removed(&item, false)?;
+            } else {
+                self.load(item)?;
+            }
+            restored += 1;
+        }
+        Ok(restored)
+    }
+
+    /// Returns the number of entries removed from the database while loading it, either because
+    /// they weren't in the `items` passed to [`new`](Self::new) or because they couldn't be
+    /// deserialized with [`Options::remove_on_deserialization_error`] set.
+    ///
+    /// This is always 0 when [`Options::keep_unrecognized`] is set or the database is read-only.
+    pub const fn removed_on_load(&self) -> usize {
+        self.removed_on_load
+    }
+
+    /// Takes the items that were removed from the database while loading it because they weren't
+    /// in the `items` passed to [`new`](Self::new), so they can be reported. Entries that
+    /// couldn't be deserialized are only counted by [`removed_on_load`](Self::removed_on_load).
+    ///
+    /// Returns an empty vector if called again.
+    pub fn take_unrecognized(&mut self) -> Vec<T> {
+        std::mem::take(&mut self.unrecognized)
+    }
+
+    /// Returns `true` if the database was opened read-only because of
+    /// [`Options::read_only_fallback`]. Changes are kept in memory but will not be saved.
+    pub const fn is_read_only(&self) -> bool {
+        self.writes.read_only
+    }
+
+    /// See [`crate::ShufflerGeneric::generation_headroom`].
+    pub fn generation_headroom(&self) -> u64 {
+        self.internal.generation_headroom()
+    }
+
+    /// Checks the internal consistency of the in-memory shuffler. See
+    /// [`crate::ShufflerGeneric::check_integrity`].
+    pub fn check_integrity(&self) -> Result<(), &'static str> {
+        self.internal.check_integrity()
+    }
+
+    /// Checks that the database can still be written to, returning a description of the first
+    /// problem found. This is cheap enough to back a readiness probe in long running programs.
+    ///
+    /// This fails if the database was opened read-only because of
+    /// [`Options::read_only_fallback`], if RocksDB has recorded background errors, such as failed
+    /// flushes or compactions, that leave the database read-only, if RocksDB has stopped accepting
+    /// writes, or if [`check_integrity`](Self::check_integrity) fails.
+    pub fn check_health(&self) -> Result<(), String> {
+        if self.writes.read_only {
+            return Err("The database was opened read-only".to_owned());
+        }
+
+        let property = |name| {
+            self.db
+                .property_int_value(name)
+                .map_err(|e| format!("Failed to read {name} from the database: {e}"))
+                .map(Option::unwrap_or_default)
+        };
+
+        let errors = property("rocksdb.background-errors")?;
+        if errors != 0 {
+            return Err(format!("The database has recorded {errors} background errors"));
+        }
+
+        if property("rocksdb.is-write-stopped")? != 0 {
+            return Err("The database has stopped accepting writes".to_owned());
+        }
+
+        self.check_integrity().map_err(ToOwned::to_owned)
+    }
+
+    /// See [`crate::ShufflerGeneric::bias`].
+    pub fn bias(&self) -> f64 {
+        self.internal.bias()
+    }
+
+    /// See [`crate::ShufflerGeneric::set_bias`]. The bias is not stored in the database.
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN bias.
+    pub fn set_bias(&mut self, bias: f64) {
+        self.internal.set_bias(bias);
+    }
+
+    /// See [`crate::ShufflerGeneric::set_bias_schedule`]. The schedule is not stored in the
+    /// database.
+    pub fn set_bias_schedule(&mut self, schedule: BiasSchedule) {
+        self.internal.set_bias_schedule(schedule);
+    }
+
+    /// See [`crate::ShufflerGeneric::settings`].
+    pub fn settings(&self) -> Settings {
+        self.internal.settings()
+    }
+
+    /// See [`crate::ShufflerGeneric::apply_settings`]. Settings are not stored in the database,
+    /// so they need to be applied again each time it is opened.
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN bias.
+    pub fn apply_settings(&mut self, settings: Settings) {
+        self.internal.apply_settings(settings);
+    }
+
+    /// See [`crate::ShufflerGeneric::set_strict_rotation`]. This is not stored in the database.
+    pub fn set_strict_rotation(&mut self, strict: bool) {
+        self.internal.set_strict_rotation(strict);
+    }
+
+    /// See [`crate::ShufflerGeneric::set_weight_fn`]. Weights are not stored in the database.
+    pub fn set_weight_fn(&mut self, weight: impl Fn(&T) -> f64 + Send + Sync + 'static) {
+        self.internal.set_weight_fn(weight);
+    }
+
+    /// See [`crate::ShufflerGeneric::clear_weight_fn`].
+    pub fn clear_weight_fn(&mut self) {
+        self.internal.clear_weight_fn();
+    }
+
+    fn shutdown(&self) -> Result<(), Error> {
+        if !self.writes.read_only {
+            self.db.flush()?;
+        }
+        self.db.cancel_all_background_work(true);
+        Ok(())
+    }
+
+    fn validate(&self, item: T) -> Result<T, Error> {
+        match &self.validator {
+            Some(v) => (v.0)(item).map_err(Error::Invalid),
+            None => Ok(item),
+        }
+    }
+
     fn get(&mut self, item: &T) -> Result<Option<u64>, Error> {
         let key = encode::to_vec(item)?;
 
@@ -254,18 +620,123 @@ where
         }
     }
 
+    // Items are only moved into the shuffler once nothing else can fail, so they're handed back
+    // along with any error. Items rejected by the validator can't be handed back.
     fn load_all(
         db: &DB,
         internal: &mut BaseShuffler<T, H, R>,
-        remove_error: bool,
-        keep_unrecognized: bool,
+        options: &mut Options<T>,
+        read_only: bool,
         items: Option<Vec<T>>,
-    ) -> Result<(), Error> {
+        cancel: &AtomicBool,
+    ) -> Result<Removed<T>, (Error, Option<Vec<T>>)> {
+        let items = match (&options.validator, items) {
+            (Some(validator), Some(items)) => {
+                let skip = options.remove_on_deserialization_error;
+                match Self::validate_items(validator, items, skip) {
+                    Ok(items) => Some(items),
+                    Err((e, items)) => return Err((e, Some(items))),
+                }
+            }
+            (_, items) => items,
+        };
+
+        let (removed, new) =
+            match Self::read_all(db, internal, options, read_only, items.as_deref(), cancel) {
+                Ok(r) => r,
+                Err(e) => return Err((e, items)),
+            };
+
+        let mut items: Vec<_> = items.into_iter().flatten().map(Some).collect();
+        for (i, gen) in new {
+            // Each index is only returned once.
+            internal.tree.insert(items[i].take().unwrap(), gen);
+        }
+        Ok(removed)
+    }
+
+    fn validate_items(
+        validator: &Validator<T>,
+        items: Vec<T>,
+        skip_invalid: bool,
+    ) -> Result<Vec<T>, (Error, Vec<T>)> {
+        let mut valid = Vec::with_capacity(items.len());
+        let mut items = items.into_iter();
+
+        while let Some(item) = items.next() {
+            match (validator.0)(item) {
+                Ok(item) => valid.push(item),
+                Err(e) if skip_invalid => warn!("Skipping item rejected by the validator: {e}"),
+                Err(e) => {
+                    valid.extend(items);
+                    return Err((Error::Invalid(e), valid));
+                }
+            }
+        }
+        Ok(valid)
+    }
+
+    // Items in the database must pass the validator unchanged, since they couldn't have been added
+    // with it set otherwise.
+    fn check_loaded(validator: Option<&Validator<T>>, item: T, key: &[u8]) -> Result<T, Error> {
+        let Some(validator) = validator else {
+            return Ok(item);
+        };
+
+        let item = (validator.0)(item).map_err(Error::Invalid)?;
+        if encode::to_vec(&item)? == key {
+            Ok(item)
+        } else {
+            Err(Error::Invalid("The validator changed an item in the database".to_owned()))
+        }
+    }
+
+    // Loads the database and writes any changes, returning the indices of the items that weren't
+    // in the database along with their new generations.
+    fn read_all(
+        db: &DB,
+        internal: &mut BaseShuffler<T, H, R>,
+        options: &mut Options<T>,
+        read_only: bool,
+        items: Option<&[T]>,
+        cancel: &AtomicBool,
+    ) -> Result<(Removed<T>, Added), Error> {
+        let remove_error = options.remove_on_deserialization_error;
         let mut batch = WriteBatch::default();
+        let mut removed = 0;
+
+        let mut valid: Option<AHashMap<&T, usize>> =
+            items.map(|v| v.iter().enumerate().map(|(i, item)| (item, i)).collect());
+        let mut unrecognized = Vec::new();
+
+        let hidden_cf = db.cf_handle(SOFT_REMOVED);
+        let mut hidden = AHashSet::new();
+        if let (Some(cf), false) = (hidden_cf, options.include_soft_removed) {
+            for r in db.iterator_cf(cf, Start) {
+                hidden.insert(r?.0);
+            }
+        }
 
-        let mut valid: Option<AHashSet<_>> = items.map(|v| v.into_iter().collect());
+        // The estimate is only worth reading when something will report it.
+        let total = match options.progress {
+            Some(_) => db.property_int_value("rocksdb.estimate-num-keys").ok().flatten(),
+            None => None,
+        };
+        let total = total.map_or(0, |t| t as usize);
+        let mut read = 0;
 
         for r in db.iterator(Start) {
+            if cancel.load(Ordering::Relaxed) {
+                return Err(Error::Cancelled);
+            }
+
+            read += 1;
+            if read % PROGRESS_INTERVAL == 0 {
+                if let Some(progress) = &mut options.progress {
+                    progress(read, read.max(total));
+                }
+            }
+
             let (key, value) = match r {
                 Ok((k, v)) => (k, v),
                 Err(e) => return Err(e.into()),
@@ -276,7 +747,9 @@ where
                 Ok(k) => k,
                 Err(e) => {
                     if remove_error {
-                        batch.delete(key);
+                        warn!("Removing item that could not be deserialized: {e}");
+                        delete_key(&mut batch, hidden_cf, &key);
+                        removed += 1;
                         continue;
                     }
                     return Err(e.into());
@@ -287,71 +760,229 @@ where
                 Ok(g) => g,
                 Err(e) => {
                     if remove_error {
-                        batch.delete(key);
+                        warn!(
+                            "Removing item with a generation that could not be deserialized: {e}"
+                        );
+                        delete_key(&mut batch, hidden_cf, &key);
+                        removed += 1;
                         continue;
                     }
                     return Err(e.into());
                 }
             };
 
-            // Add it to the tree if it's a valid item, otherwise plan to delete it.
+            let item = match Self::check_loaded(options.validator.as_ref(), item, &key) {
+                Ok(item) => item,
+                Err(e) => {
+                    if remove_error {
+                        warn!("Removing item rejected by the validator: {e}");
+                        delete_key(&mut batch, hidden_cf, &key);
+                        removed += 1;
+                        continue;
+                    }
+                    return Err(e);
+                }
+            };
+
+            // Add it to the tree if it's a valid item, otherwise plan to delete it. Soft removed
+            // items that are still valid stay in the database without being loaded.
             if let Some(valid) = &mut valid {
-                if let Some(item) = valid.take(&item) {
-                    internal.tree.insert(item, gen);
+                if valid.remove(&item).is_some() {
+                    if !hidden.contains(&key) {
+                        internal.tree.insert(item, gen);
+                    }
                 } else {
-                    batch.delete(key);
+                    delete_key(&mut batch, hidden_cf, &key);
+                    removed += 1;
+                    unrecognized.push(item);
                 }
-            } else {
+            } else if !hidden.contains(&key) {
                 internal.tree.insert(item, gen);
             }
         }
 
-        if keep_unrecognized {
+        if options.keep_unrecognized {
             batch.clear();
+            removed = 0;
+            unrecognized.clear();
         }
+        let mut removed = (removed, unrecognized);
 
-        // Add all of the new items to the tree
-        for item in valid.into_iter().flatten() {
+        // Inserting new items never changes the range of generations, so they can be assigned
+        // before any are inserted.
+        let mut new = Vec::new();
+        for (item, i) in valid.into_iter().flatten() {
             let gen = internal.add_generation();
 
-            let key = encode::to_vec(&item)?;
+            let key = encode::to_vec(item)?;
             let value = encode::to_vec(&gen)?;
             batch.put(key, value);
 
-            internal.tree.insert(item, gen);
+            new.push((i, gen));
+        }
+
+        // Nothing has been written yet, so this is the last point where cancelling is clean.
+        if cancel.load(Ordering::Relaxed) {
+            return Err(Error::Cancelled);
         }
 
-        if !batch.is_empty() {
+        if read_only {
+            if !batch.is_empty() {
+                warn!("Database is read-only, changes to {} items will not be saved", batch.len());
+            }
+            removed = (0, Vec::new());
+        } else if !batch.is_empty() {
             db.write(batch)?;
         }
-        Ok(())
+
+        if let Some(progress) = &mut options.progress {
+            progress(read, read);
+        }
+        Ok((removed, new))
     }
 
-    fn put_batch(db: &DB, items: &[&T], gen: u64) -> Result<(), Error> {
-        let gen = encode::to_vec(&gen)?;
+    fn put_batch(db: &DB, writes: Writes, items: &[&T], gen: u64) -> Result<(), Error> {
+        Self::put_items(db, writes, items, gen, None)
+    }
 
-        let mut batch = WriteBatch::default();
+    // Writes a newly added item and clears any record of it being soft removed in the same batch,
+    // so a failure can't leave it hidden from the next load.
+    fn put_added(db: &DB, writes: Writes, item: &T, gen: u64) -> Result<(), Error> {
+        Self::put_items(db, writes, &[item], gen, db.cf_handle(SOFT_REMOVED))
+    }
 
-        for item in items {
-            let key = encode::to_vec(*item)?;
+    // WriteBatch copies keys and values, so one buffer is reused for every key. Writing consumes
+    // the batch, so it's rebuilt for each retry.
+    fn put_items(
+        db: &DB,
+        writes: Writes,
+        items: &[&T],
+        gen: u64,
+        hidden: Option<&ColumnFamily>,
+    ) -> Result<(), Error> {
+        let start = Instant::now();
+        let mut gen_buf = [0; 9];
+        let gen = encode_gen(gen, &mut gen_buf)?;
+        let mut key = Vec::new();
 
-            batch.put(key, &gen);
-        }
+        writes.run(|| {
+            let mut batch = WriteBatch::default();
+
+            for item in items {
+                key.clear();
+                encode::write(&mut key, *item)?;
 
-        db.write(batch).map_err(Into::into)
+                batch.put(&key, gen);
+                if let Some(hidden) = hidden {
+                    batch.delete_cf(hidden, &key);
+                }
+            }
+
+            db.write(batch).map_err(Into::into)
+        })?;
+
+        warn_if_slow(start, items.len());
+        Ok(())
+    }
+
+    fn put_one(
+        db: &DB,
+        writes: Writes,
+        key_buf: &mut Vec<u8>,
+        item: &T,
+        gen: u64,
+    ) -> Result<(), Error> {
+        let start = Instant::now();
+        key_buf.clear();
+        encode::write(&mut *key_buf, item)?;
+
+        let mut gen_buf = [0; 9];
+        let gen = encode_gen(gen, &mut gen_buf)?;
+        writes.run(|| db.put(&*key_buf, gen).map_err(Into::into))?;
+
+        warn_if_slow(start, 1);
+        Ok(())
     }
 
     fn handle_reset(&self) -> Result<(), Error> {
-        Self::put_batch(&self.db, &self.values(), 0)
+        warn!("Generations overflowed, resetting all {} items to generation 0", self.size());
+        Self::put_batch(&self.db, self.writes, &self.values(), 0)
+    }
+
+    // Deletes items along with any records of them being soft removed.
+    fn delete_keys(db: &DB, writes: Writes, keys: &[Vec<u8>]) -> Result<(), Error> {
+        let hidden = db.cf_handle(SOFT_REMOVED);
+
+        writes.run(|| {
+            let mut batch = WriteBatch::default();
+            for key in keys {
+                delete_key(&mut batch, hidden, key);
+            }
+
+            db.write(batch).map_err(Into::into)
+        })
     }
 
     fn delete(&self, item: &T) -> Result<(), Error> {
         let key = encode::to_vec(item)?;
 
-        self.db.delete(key).map_err(Into::into)
+        Self::delete_keys(&self.db, self.writes, &[key])
+    }
+
+    fn is_soft_removed(&self, item: &T) -> Result<bool, Error> {
+        let Some(hidden) = self.db.cf_handle(SOFT_REMOVED) else {
+            return Ok(false);
+        };
+        let key = encode::to_vec(item)?;
+
+        Ok(self.db.get_pinned_cf(hidden, key)?.is_some())
+    }
+
+    // Records or clears an item being soft removed. Clearing does nothing if soft removes have
+    // never been persisted in this database.
+    fn set_soft_removed(&self, item: &T, removed: bool) -> Result<(), Error> {
+        let Some(hidden) = self.db.cf_handle(SOFT_REMOVED) else {
+            return Ok(());
+        };
+        let key = encode::to_vec(item)?;
+
+        self.writes.run(|| {
+            let mut batch = WriteBatch::default();
+            if removed {
+                batch.put_cf(hidden, &key, []);
+            } else {
+                batch.delete_cf(hidden, &key);
+            }
+
+            self.db.write(batch).map_err(Into::into)
+        })
+    }
+}
+
+
+// Timing includes any retries, since they're part of how long the caller waited.
+fn warn_if_slow(start: Instant, items: usize) {
+    let elapsed = start.elapsed();
+    if elapsed > SLOW_OPERATION {
+        let s = if items == 1 { "" } else { "s" };
+        warn!("Writing {items} item{s} to the database took {elapsed:?}");
     }
 }
 
+fn delete_key(batch: &mut WriteBatch, hidden: Option<&ColumnFamily>, key: &[u8]) {
+    batch.delete(key);
+    if let Some(hidden) = hidden {
+        batch.delete_cf(hidden, key);
+    }
+}
+
+// A MessagePack encoded u64 is at most 9 bytes, so generations are encoded on the stack.
+fn encode_gen(gen: u64, buf: &mut [u8; 9]) -> Result<&[u8], Error> {
+    let mut w = &mut buf[..];
+    encode::write(&mut w, &gen)?;
+    let len = 9 - w.len();
+    Ok(&buf[..len])
+}
 
 impl<T: Item> Shuffler<T> {
     /// Creates a new [`Shuffler`] pointing to the given RocksDB database with default behaviour.
@@ -384,9 +1015,37 @@ impl<T: Item> Shuffler<T> {
     /// Panics if given a negative or NaN value in `options.bias`.
     pub fn new<P: AsRef<Path>>(
         path: P,
-        options: Options,
+        options: Options<T>,
+        items: Option<Vec<T>>,
+    ) -> Result<Self, Error> {
+        Self::new_cancellable(path, options, items, &AtomicBool::new(false))
+    }
+
+    /// Creates a new [`Shuffler`] as in [`new`](Self::new), but stops loading and returns
+    /// [`Error::Cancelled`] once `cancel` is set, so loading a very large database can be aborted
+    /// from another thread.
+    ///
+    /// Cancelling never leaves a partially loaded shuffler and never changes the database, even
+    /// when `items` would have added or removed items.
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN value in `options.bias`.
+    pub fn new_cancellable<P: AsRef<Path>>(
+        path: P,
+        options: Options<T>,
         items: Option<Vec<T>>,
+        cancel: &AtomicBool,
     ) -> Result<Self, Error> {
+        Self::open(path.as_ref(), options, items, cancel).map_err(|(e, _)| e)
+    }
+
+    // Hands back items on errors, as long as they haven't been moved into the shuffler.
+    fn open(
+        path: &Path,
+        mut options: Options<T>,
+        items: Option<Vec<T>>,
+        cancel: &AtomicBool,
+    ) -> Result<Self, (Error, Option<Vec<T>>)> {
         let mut db_options = rocksdb::Options::default();
         db_options.set_max_open_files(100);
         db_options.set_compression_type(rocksdb::DBCompressionType::Lz4);
@@ -396,21 +1055,53 @@ impl<T: Item> Shuffler<T> {
         db_options.set_compaction_readahead_size(2 * 1024 * 1024);
         db_options.set_keep_log_file_num(10);
 
-        let db = DB::open(&db_options, path)?;
+        // Every existing column family has to be opened, but the one for soft removed items is
+        // only created once it's needed.
+        let mut cfs = DB::list_cf(&db_options, path)
+            .unwrap_or_else(|_| vec![rocksdb::DEFAULT_COLUMN_FAMILY_NAME.to_owned()]);
+        if options.persist_soft_removes && !cfs.iter().any(|cf| cf == SOFT_REMOVED) {
+            cfs.push(SOFT_REMOVED.to_owned());
+        }
 
-        let mut internal = crate::Shuffler::new(options.bias, options.new_item_handling);
+        let start = Instant::now();
+        let (db, read_only) = match DB::open_cf(&db_options, path, &cfs) {
+            Ok(db) => (db, false),
+            Err(e) if options.read_only_fallback => {
+                warn!("Opening {path:?} read-only, changes will not be saved: {e}");
+                match DB::open_cf_for_read_only(&db_options, path, &cfs, false) {
+                    Ok(db) => (db, true),
+                    // The original error is more useful than the read-only one.
+                    Err(_) => return Err((e.into(), items)),
+                }
+            }
+            Err(e) => return Err((e.into(), items)),
+        };
 
-        Self::load_all(
-            &db,
-            &mut internal,
-            options.remove_on_deserialization_error,
-            options.keep_unrecognized,
-            items,
-        )?;
+        let mut internal = options.in_memory();
+
+        let (removed_on_load, unrecognized) =
+            Self::load_all(&db, &mut internal, &mut options, read_only, items, cancel)?;
+
+        let elapsed = start.elapsed();
+        if elapsed > SLOW_OPERATION {
+            warn!("Loading {} items from {path:?} took {elapsed:?}", internal.size());
+        } else {
+            debug!("Loaded {} items from {path:?} in {elapsed:?}", internal.size());
+        }
 
         let shuffler = Self {
             internal: ManuallyDrop::new(internal),
-            db,
+            db: Arc::new(db),
+            key_buf: Vec::new(),
+            removed_on_load,
+            unrecognized,
+            persist_soft_removes: options.persist_soft_removes,
+            writes: Writes {
+                read_only,
+                attempts: options.retries,
+                backoff: options.retry_backoff,
+            },
+            validator: options.validator.take(),
             closed: false,
             leak: false,
         };
@@ -427,3 +1118,791 @@ where
     R: Rng,
 {
 }
+
+impl<T, H, R> crate::private::MarkSelected for ShufflerGeneric<T, H, R>
+where
+    T: Item,
+    H: Hasher + Clone,
+    R: Rng,
+{
+    fn mark_selected(&mut self, items: &[&T]) -> Result<(), Self::Error> {
+        let (gen, reset) = self.internal.next_generation();
+        if reset {
+            self.handle_reset()?;
+        }
+
+        let mut present = Vec::with_capacity(items.len());
+        for item in items {
+            if let Some(node) = self.internal.tree.find_node(item) {
+                Node::set_generation(node, gen.get());
+                present.push(*item);
+            }
+        }
+
+        Self::put_batch(&self.db, self.writes, &present, gen.get())
+    }
+}
+
+
+/// A read-only handle to the database of a [`Shuffler`], created with
+/// [`ShufflerGeneric::reader`]. Readers can be cloned and sent to other threads, such as
+/// background jobs generating reports, without blocking the shuffler.
+///
+/// Readers see the database, not the in-memory shuffler, so they include items that aren't loaded.
+/// The database stays open until the shuffler and every reader have been dropped, but readers
+/// should not be used after the shuffler has been closed.
+#[derive(Debug)]
+pub struct Reader<T> {
+    db: Arc<DB>,
+    _item: PhantomData<fn() -> T>,
+}
+
+impl<T> Clone for Reader<T> {
+    fn clone(&self) -> Self {
+        Self { db: self.db.clone(), _item: PhantomData }
+    }
+}
+
+impl<T: Item> Reader<T> {
+    /// Reads every stored item from a snapshot of the database, so writes made while reading are
+    /// not seen. As with [`ShufflerGeneric::dump_database`], soft removed items are included and
+    /// marked as such. Records are returned in no specific order.
+    pub fn dump(&self) -> Result<Vec<Record<T>>, Error> {
+        let snapshot = self.db.snapshot();
+
+        let mut hidden = AHashSet::new();
+        if let Some(cf) = self.db.cf_handle(SOFT_REMOVED) {
+            for r in snapshot.iterator_cf(cf, Start) {
+                hidden.insert(r?.0);
+            }
+        }
+
+        let mut records = Vec::new();
+        for r in snapshot.iterator(Start) {
+            let (key, value) = r?;
+            records.push(Record {
+                item: T::deserialize(&mut Deserializer::new(&*key))?,
+                generation: u64::deserialize(&mut Deserializer::new(&*value))?,
+                soft_removed: hidden.contains(&key),
+            });
+        }
+        Ok(records)
+    }
+
+    /// Reads the stored generation of `item`, or `None` if it isn't in the database.
+    pub fn get(&self, item: &T) -> Result<Option<u64>, Error> {
+        let key = encode::to_vec(item)?;
+
+        match self.db.get_pinned(key)? {
+            Some(value) => Ok(Some(u64::deserialize(&mut Deserializer::new(&*value))?)),
+            None => Ok(None),
+        }
+    }
+}
+
+
+/// A read-only replica of a [`Shuffler`]'s database that reloads its in-memory state when it's
+/// older than a refresh interval, for showing near-live selection history without going through
+/// the process writing to the database.
+///
+/// The replica opens the database as a RocksDB secondary instance, which works whether or not the
+/// database is open elsewhere and never writes to it. Nothing selected from the replica is saved.
+#[derive(Debug)]
+pub struct Replica<T: Item> {
+    db: DB,
+    options: Options<T>,
+    internal: crate::Shuffler<T>,
+    interval: Duration,
+    refreshed: Instant,
+}
+
+impl<T: Item> Replica<T> {
+    /// Opens a replica of the database at `path`, keeping its own logs in `secondary_path`, which
+    /// must not be shared. Items are loaded as in [`Shuffler::new`] using `options`, except that
+    /// nothing is removed from the database.
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN value in `options.bias`.
+    pub fn new<P: AsRef<Path>, S: AsRef<Path>>(
+        path: P,
+        secondary_path: S,
+        options: Options<T>,
+        interval: Duration,
+    ) -> Result<Self, Error> {
+        let mut db_options = rocksdb::Options::default();
+        // Secondary instances must keep every file open.
+        db_options.set_max_open_files(-1);
+
+        let cfs = DB::list_cf(&db_options, path.as_ref())?;
+        let db =
+            DB::open_cf_as_secondary(&db_options, path.as_ref(), secondary_path.as_ref(), cfs)?;
+
+        let internal = options.in_memory();
+        let mut replica = Self { db, options, internal, interval, refreshed: Instant::now() };
+        replica.refresh()?;
+        Ok(replica)
+    }
+
+    /// Catches up with the primary database and reloads every item, replacing the in-memory
+    /// shuffler.
+    pub fn refresh(&mut self) -> Result<(), Error> {
+        self.db.try_catch_up_with_primary()?;
+
+        let mut internal = self.options.in_memory();
+        Shuffler::load_all(
+            &self.db,
+            &mut internal,
+            &mut self.options,
+            true,
+            None,
+            &AtomicBool::new(false),
+        )
+        .map_err(|(e, _)| e)?;
+
+        self.internal = internal;
+        self.refreshed = Instant::now();
+        Ok(())
+    }
+
+    /// Returns the in-memory shuffler, first refreshing it if it is older than the refresh
+    /// interval.
+    pub fn shuffler(&mut self) -> Result<&mut crate::Shuffler<T>, Error> {
+        if self.refreshed.elapsed() >= self.interval {
+            self.refresh()?;
+        }
+        Ok(&mut self.internal)
+    }
+
+    /// Returns when the in-memory shuffler was last refreshed.
+    pub const fn refreshed(&self) -> Instant {
+        self.refreshed
+    }
+}
+
+
+/// A [`Shuffler`] that falls back to an in-memory shuffler instead of returning errors when the
+/// database can't be opened or a database operation fails.
+///
+/// Once it has fallen back the database is closed and never touched again, so any further changes
+/// are lost when the shuffler is dropped. The error that caused the fallback is available from
+/// [`error`](Self::error) so it can be reported.
+///
+/// Errors from [`close`](PersistentShuffler::close) are always lost.
+#[derive(Debug)]
+pub struct FallbackShuffler<T: Item> {
+    state: State<T>,
+    error: Option<Error>,
+}
+
+#[derive(Debug)]
+enum State<T: Item> {
+    Persistent(Shuffler<T>),
+    Memory(crate::Shuffler<T>),
+}
+
+impl<T: Item> FallbackShuffler<T> {
+    /// Creates a new [`FallbackShuffler`] pointing to the given RocksDB database. See
+    /// [`Shuffler::new`].
+    ///
+    /// If the database can't be opened an in-memory shuffler is created from `options` and
+    /// `items` instead.
+    ///
+    /// # Panics
+    /// Panics if given a negative or NaN value in `options.bias`.
+    pub fn new<P: AsRef<Path>>(path: P, options: Options<T>, items: Option<Vec<T>>) -> Self {
+        let mut memory = options.in_memory();
+
+        match Shuffler::open(path.as_ref(), options, items, &AtomicBool::new(false)) {
+            Ok(s) => Self { state: State::Persistent(s), error: None },
+            Err((e, items)) => {
+                for item in items.into_iter().flatten() {
+                    memory.inf_add(item);
+                }
+                Self { state: State::Memory(memory), error: Some(e) }
+            }
+        }
+    }
+}
+
+impl<T: Item> FallbackShuffler<T> {
+    /// Returns the error that caused this shuffler to fall back to memory, if it has.
+    pub const fn error(&self) -> Option<&Error> {
+        self.error.as_ref()
+    }
+
+    /// Returns `true` if this shuffler is still backed by the database.
+    pub const fn is_persistent(&self) -> bool {
+        self.error.is_none()
+    }
+
+    /// Like [`Shuffler::check_health`], but also fails once this shuffler has fallen back to
+    /// memory.
+    pub fn check_health(&self) -> Result<(), String> {
+        if let Some(e) = &self.error {
+            return Err(format!("Using memory after a database error: {e}"));
+        }
+
+        match &self.state {
+            State::Persistent(p) => p.check_health(),
+            State::Memory(m) => m.check_integrity().map_err(ToOwned::to_owned),
+        }
+    }
+
+    // Returns the persistent shuffler if the database hasn't failed. A failure can happen while a
+    // selection still borrows the persistent shuffler, so switching to memory is deferred to here.
+    fn persistent(
+        &mut self,
+    ) -> Result<(&mut Shuffler<T>, &mut Option<Error>), &mut crate::Shuffler<T>> {
+        if self.error.is_some() {
+            if let State::Persistent(p) = &mut self.state {
+                warn!(
+                    "Continuing in memory after a database error: {}",
+                    self.error.as_ref().unwrap()
+                );
+                // SAFETY: Setting p.leak prevents the drop handler from dropping p.internal again.
+                p.leak = true;
+                let internal = unsafe { ManuallyDrop::take(&mut p.internal) };
+                self.state = State::Memory(internal);
+            }
+        }
+
+        match &mut self.state {
+            State::Persistent(p) => Ok((p, &mut self.error)),
+            State::Memory(m) => Err(m),
+        }
+    }
+
+    // Selections are made in memory first and then written to the database, so they can still be
+    // returned if the write fails.
+    fn select<'a, O>(
+        &'a mut self,
+        select: impl FnOnce(&'a mut crate::Shuffler<T>) -> Option<O>,
+        items: impl FnOnce(&O) -> &[&'a T],
+    ) -> Option<O> {
+        let (p, error) = match self.persistent() {
+            Ok(p) => p,
+            Err(m) => return select(m),
+        };
+
+        let (gen, reset) = p.internal.next_generation();
+        let mut result = if reset {
+            Shuffler::put_batch(&p.db, p.writes, &p.internal.values(), 0)
+        } else {
+            Ok(())
+        };
+
+        let selected = select(&mut p.internal);
+        if let (Ok(()), Some(selected)) = (&result, &selected) {
+            result = Shuffler::put_batch(&p.db, p.writes, items(selected), gen.get());
+        }
+
+        if let Err(e) = result {
+            *error = Some(e);
+        }
+        selected
+    }
+}
+
+impl<T: Item> PersistentShuffler for FallbackShuffler<T> {
+    fn load(&mut self, item: Self::Item) -> Result<bool, Self::Error> {
+        let (p, error) = match self.persistent() {
+            Ok(p) => p,
+            Err(m) => return m.add(item),
+        };
+
+        if p.internal.tree.find_node(&item).is_some() {
+            return Ok(false);
+        }
+
+        match p.get(&item) {
+            Ok(Some(gen)) => {
+                if let Err(e) = p.set_soft_removed(&item, false) {
+                    *error = Some(e);
+                }
+                Ok(p.internal.tree.insert(item, gen))
+            }
+            Ok(None) => self.add(item),
+            Err(e) => {
+                *error = Some(e);
+                self.add(item)
+            }
+        }
+    }
+
+    fn soft_remove(&mut self, item: &Self::Item) -> Result<Option<Self::Item>, Self::Error> {
+        let (p, error) = match self.persistent() {
+            Ok(p) => p,
+            Err(m) => return m.remove(item),
+        };
+
+        let removed = p.internal.inf_remove(item);
+        if removed.is_some() && p.persist_soft_removes {
+            if let Err(e) = p.set_soft_removed(item, true) {
+                *error = Some(e);
+            }
+        }
+        Ok(removed)
+    }
+
+    fn compact(&mut self) -> Result<(), Self::Error> {
+        if let Ok((p, error)) = self.persistent() {
+            if let Err(e) = p.compact() {
+                *error = Some(e);
+            }
+        }
+        Ok(())
+    }
+
+    fn close(self) -> Result<(), Self::Error> {
+        if let State::Persistent(p) = self.state {
+            drop(p.close());
+        }
+        Ok(())
+    }
+
+    fn close_into_values(self) -> Result<Vec<Self::Item>, Self::Error> {
+        // The database is flushed on drop.
+        Ok(self.into_values())
+    }
+
+    fn close_leak(self) -> Result<(), Self::Error> {
+        match self.state {
+            State::Persistent(p) => drop(p.close_leak()),
+            State::Memory(m) => std::mem::forget(m),
+        }
+        Ok(())
+    }
+}
+
+impl<T: Item> AwShuffler for FallbackShuffler<T> {
+    type Error = Infallible;
+    type Item = T;
+
+    fn add(&mut self, item: Self::Item) -> Result<bool, Self::Error> {
+        let (p, error) = match self.persistent() {
+            Ok(p) => p,
+            Err(m) => return m.add(item),
+        };
+
+        let gen = p.internal.add_generation();
+        if let Err(e) = Shuffler::put_added(&p.db, p.writes, &item, gen) {
+            *error = Some(e);
+        }
+        Ok(p.internal.tree.insert(item, gen))
+    }
+
+    fn remove(&mut self, item: &Self::Item) -> Result<Option<Self::Item>, Self::Error> {
+        let (p, error) = match self.persistent() {
+            Ok(p) => p,
+            Err(m) => return m.remove(item),
+        };
+
+        let removed = p.internal.inf_remove(item);
+        if removed.is_some() {
+            if let Err(e) = p.delete(item) {
+                *error = Some(e);
+            }
+        }
+        Ok(removed)
+    }
+
+    fn next(&mut self) -> Result<Option<&Self::Item>, Self::Error> {
+        Ok(self.select(InfallibleShuffler::inf_next, std::slice::from_ref))
+    }
+
+    fn next_n(&mut self, n: usize) -> Result<Option<Vec<&Self::Item>>, Self::Error> {
+        Ok(self.select(|s| s.inf_next_n(n), Vec::as_slice))
+    }
+
+    fn unique_n(&mut self, n: usize) -> Result<Option<Vec<&Self::Item>>, Self::Error> {
+        Ok(self.select(|s| s.inf_unique_n(n), Vec::as_slice))
+    }
+
+    fn size(&self) -> usize {
+        match &self.state {
+            State::Persistent(p) => p.size(),
+            State::Memory(m) => m.size(),
+        }
+    }
+
+    fn contains(&self, item: &Self::Item) -> bool {
+        match &self.state {
+            State::Persistent(p) => p.contains(item),
+            State::Memory(m) => m.contains(item),
+        }
+    }
+
+    fn values(&self) -> Vec<&Self::Item> {
+        match &self.state {
+            State::Persistent(p) => p.values(),
+            State::Memory(m) => m.values(),
+        }
+    }
+
+    fn into_values(self) -> Vec<Self::Item> {
+        match self.state {
+            State::Persistent(p) => p.into_values(),
+            State::Memory(m) => m.into_values(),
+        }
+    }
+
+    fn dump(&self) -> Vec<(&Self::Item, u64)> {
+        match &self.state {
+            State::Persistent(p) => p.dump(),
+            State::Memory(m) => m.dump(),
+        }
+    }
+}
+
+impl<T: Item> crate::private::Sealed for FallbackShuffler<T> {}
+
+impl<T: Item> crate::private::MarkSelected for FallbackShuffler<T> {
+    fn mark_selected(&mut self, items: &[&T]) -> Result<(), Self::Error> {
+        match self.persistent() {
+            Ok((p, error)) => {
+                if let Err(e) = p.mark_selected(items) {
+                    *error = Some(e);
+                }
+                Ok(())
+            }
+            Err(m) => m.mark_selected(items),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::cell::Cell;
+    use std::fs;
+    use std::sync::mpsc;
+
+    use tempfile::tempdir;
+
+    use super::*;
+
+    fn strings(items: &[&str]) -> Vec<String> {
+        items.iter().map(|s| (*s).to_owned()).collect()
+    }
+
+    fn sorted(shuffler: &impl AwShuffler<Item = String>) -> Vec<String> {
+        let mut values: Vec<_> = shuffler.values().into_iter().cloned().collect();
+        values.sort_unstable();
+        values
+    }
+
+    fn soft_removed(shuffler: &Shuffler<String>) -> Vec<String> {
+        let mut items = shuffler.soft_removed().unwrap();
+        items.sort_unstable();
+        items
+    }
+
+    fn has_soft_removed_cf(path: &Path) -> bool {
+        let cfs = DB::list_cf(&rocksdb::Options::default(), path).unwrap();
+        cfs.iter().any(|cf| cf == SOFT_REMOVED)
+    }
+
+    fn trim(item: String) -> Result<String, String> {
+        match item.trim() {
+            "" => Err("empty".to_owned()),
+            trimmed => Ok(trimmed.to_owned()),
+        }
+    }
+
+    #[test]
+    fn validator_add() {
+        let dir = tempdir().unwrap();
+        let options = Options::default().validator(trim);
+        let mut s = Shuffler::new(dir.path(), options, Some(strings(&[" a"]))).unwrap();
+
+        assert!(s.add("b ".to_owned()).unwrap());
+        assert!(!s.add(" b ".to_owned()).unwrap());
+        assert!(matches!(s.add(" ".to_owned()), Err(Error::Invalid(_))));
+        assert!(matches!(s.load(String::new()), Err(Error::Invalid(_))));
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+        s.close().unwrap();
+
+        // Only the normalized items were written.
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+    }
+
+    #[test]
+    fn validator_load() {
+        let dir = tempdir().unwrap();
+        let s = Shuffler::new_default(dir.path(), Some(strings(&["a", " b", ""]))).unwrap();
+        s.close().unwrap();
+
+        let options = Options::default().validator(trim);
+        assert!(matches!(Shuffler::new(dir.path(), options, None), Err(Error::Invalid(_))));
+        let options = Options::default().validator(trim);
+        let err = Shuffler::new(dir.path(), options, Some(strings(&["a", " "]))).unwrap_err();
+        assert!(matches!(err, Error::Invalid(_)));
+
+        // Rejected and changed entries are removed, and rejected items are skipped.
+        let options = Options::default().validator(trim).remove_on_deserialization_error(true);
+        let s = Shuffler::new(dir.path(), options, Some(strings(&["a", " c", " "]))).unwrap();
+        assert_eq!(s.removed_on_load(), 2);
+        assert_eq!(sorted(&s), strings(&["a", "c"]));
+        s.close().unwrap();
+
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "c"]));
+    }
+
+    #[test]
+    fn soft_removes() {
+        let dir = tempdir().unwrap();
+        let items = strings(&["a", "b", "c", "d"]);
+        let persist = || Options::default().persist_soft_removes(true);
+
+        let mut s = Shuffler::new_default(dir.path(), Some(items.clone())).unwrap();
+        s.soft_remove(&"d".to_owned()).unwrap();
+        s.close().unwrap();
+        assert!(!has_soft_removed_cf(dir.path()));
+
+        let mut s = Shuffler::new(dir.path(), persist(), Some(items.clone())).unwrap();
+        for item in ["a", "b", "c"] {
+            assert_eq!(s.soft_remove(&item.to_owned()).unwrap(), Some(item.to_owned()));
+        }
+        s.close().unwrap();
+        assert!(has_soft_removed_cf(dir.path()));
+
+        // Recorded soft removes are respected even without persist_soft_removes.
+        let mut s = Shuffler::new_default(dir.path(), Some(items.clone())).unwrap();
+        assert_eq!(sorted(&s), strings(&["d"]));
+        assert_eq!(soft_removed(&s), strings(&["a", "b", "c"]));
+        assert!(s.add("a".to_owned()).unwrap());
+        s.close().unwrap();
+
+        let options = Options::default().include_soft_removed(true);
+        let mut s = Shuffler::new(dir.path(), options, Some(items)).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "b", "c", "d"]));
+        assert_eq!(soft_removed(&s), strings(&["b", "c"]));
+        assert_eq!(s.remove(&"b".to_owned()).unwrap(), Some("b".to_owned()));
+        s.close().unwrap();
+
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "d"]));
+        assert_eq!(soft_removed(&s), strings(&["c"]));
+    }
+
+    #[test]
+    fn restore_soft_removed() {
+        let dir = tempdir().unwrap();
+        let options = Options::default().persist_soft_removes(true);
+        let mut s = Shuffler::new(dir.path(), options, Some(strings(&["a", "b"]))).unwrap();
+        s.soft_remove(&"a".to_owned()).unwrap();
+        s.close().unwrap();
+
+        let mut s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["b"]));
+        assert_eq!(s.restore_soft_removed(strings(&["a", "b", "c"])).unwrap(), 1);
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+        s.close().unwrap();
+
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+        assert!(soft_removed(&s).is_empty());
+    }
+
+    #[test]
+    fn dump_database() {
+        let dir = tempdir().unwrap();
+        let options = Options::default().persist_soft_removes(true);
+        let mut s = Shuffler::new(dir.path(), options, Some(strings(&["a", "b"]))).unwrap();
+        s.soft_remove(&"a".to_owned()).unwrap();
+        assert_eq!(s.next().unwrap(), Some(&"b".to_owned()));
+        s.close().unwrap();
+
+        let s = Shuffler::<String>::new_default(dir.path(), None).unwrap();
+        let mut records = s.dump_database().unwrap();
+        records.sort_by(|a, b| a.item.cmp(&b.item));
+
+        let flags: Vec<_> = records.iter().map(|r| (r.item.as_str(), r.soft_removed)).collect();
+        assert_eq!(flags, vec![("a", true), ("b", false)]);
+        assert!(records[1].generation > records[0].generation);
+        assert_eq!(s.dump(), vec![(&"b".to_owned(), records[1].generation)]);
+    }
+
+    #[test]
+    fn reader() {
+        let dir = tempdir().unwrap();
+        let mut s = Shuffler::new_default(dir.path(), Some(strings(&["a"]))).unwrap();
+        let reader = s.reader();
+
+        assert_eq!(reader.dump().unwrap().len(), 1);
+        s.add("b".to_owned()).unwrap();
+
+        let other = reader.clone();
+        let records = thread::spawn(move || other.dump().unwrap()).join().unwrap();
+        assert_eq!(records.len(), 2);
+        let gen = reader.get(&"b".to_owned()).unwrap();
+        assert!(gen.is_some());
+        drop(reader);
+        s.close().unwrap();
+
+        let s = Shuffler::<String>::new_default(dir.path(), None).unwrap();
+        assert_eq!(s.reader().get(&"b".to_owned()).unwrap(), gen);
+        assert_eq!(s.reader().get(&"c".to_owned()).unwrap(), None);
+    }
+
+    #[test]
+    fn replica() {
+        let dir = tempdir().unwrap();
+        let secondary = tempdir().unwrap();
+        let mut s = Shuffler::new_default(dir.path(), Some(strings(&["a"]))).unwrap();
+
+        let interval = Duration::from_secs(3600);
+        let mut replica =
+            Replica::new(dir.path(), secondary.path(), Options::default(), interval).unwrap();
+        assert_eq!(sorted(replica.shuffler().unwrap()), strings(&["a"]));
+
+        s.add("b".to_owned()).unwrap();
+        s.close().unwrap();
+
+        // Nothing is reloaded until the interval passes or the replica is refreshed.
+        assert_eq!(sorted(replica.shuffler().unwrap()), strings(&["a"]));
+        let refreshed = replica.refreshed();
+        replica.refresh().unwrap();
+        assert!(replica.refreshed() > refreshed);
+        assert_eq!(sorted(replica.shuffler().unwrap()), strings(&["a", "b"]));
+
+        // Selections from the replica are never written.
+        replica.shuffler().unwrap().inf_remove(&"a".to_owned());
+        drop(replica);
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+    }
+
+    #[test]
+    fn retries() {
+        let dir = tempdir().unwrap();
+        let options = Options::default().retries(3, Duration::from_millis(1));
+        let mut s = Shuffler::new(dir.path(), options, None).unwrap();
+        s.add("a".to_owned()).unwrap();
+        s.next().unwrap();
+        s.close().unwrap();
+
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a"]));
+
+        // Only errors from the database that might be temporary are retried.
+        let calls = Cell::new(0);
+        let writes = Writes { read_only: false, attempts: 3, backoff: Duration::ZERO };
+        let result = writes.run(|| {
+            calls.set(calls.get() + 1);
+            Err(Error::Invalid(String::new()))
+        });
+        assert!(matches!(result, Err(Error::Invalid(_))));
+        assert_eq!(calls.get(), 1);
+    }
+
+    #[test]
+    fn read_only_fallback() {
+        let dir = tempdir().unwrap();
+        let s = Shuffler::new_default(dir.path(), Some(strings(&["a", "b"]))).unwrap();
+
+        // The lock held by the first shuffler stops the database being opened for writing again.
+        assert!(Shuffler::<String>::new_default(dir.path(), None).is_err());
+
+        let options = Options::default().read_only_fallback(true);
+        let mut read_only = Shuffler::new(dir.path(), options, Some(strings(&["a"]))).unwrap();
+        assert!(read_only.is_read_only());
+        assert!(read_only.check_health().is_err());
+        assert_eq!(read_only.removed_on_load(), 0);
+        assert_eq!(sorted(&read_only), strings(&["a"]));
+
+        assert!(read_only.add("c".to_owned()).unwrap());
+        assert_eq!(sorted(&read_only), strings(&["a", "c"]));
+        read_only.close().unwrap();
+        s.close().unwrap();
+
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert!(!s.is_read_only());
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+    }
+
+    #[test]
+    fn cancellable() {
+        let dir = tempdir().unwrap();
+        let s = Shuffler::new_default(dir.path(), Some(strings(&["a", "b"]))).unwrap();
+        s.close().unwrap();
+
+        let cancel = AtomicBool::new(true);
+        let items = Some(strings(&["a", "c"]));
+        let result = Shuffler::new_cancellable(dir.path(), Options::default(), items, &cancel);
+        assert!(matches!(result, Err(Error::Cancelled)));
+
+        // Cancelling didn't add c or remove b.
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+    }
+
+    #[test]
+    fn load_progress() {
+        let dir = tempdir().unwrap();
+        let s = Shuffler::new_default(dir.path(), Some(strings(&["a", "b", "c"]))).unwrap();
+        s.close().unwrap();
+
+        let (tx, rx) = mpsc::channel();
+        let options = Options::default().load_progress(move |read, total| {
+            tx.send((read, total)).unwrap();
+        });
+        let s = Shuffler::<String>::new(dir.path(), options, None).unwrap();
+        s.close().unwrap();
+
+        // Fewer keys than the reporting interval, so only the final call is made.
+        assert_eq!(rx.iter().collect::<Vec<_>>(), vec![(3, 3)]);
+    }
+
+    #[test]
+    fn take_unrecognized() {
+        let dir = tempdir().unwrap();
+        let s = Shuffler::new_default(dir.path(), Some(strings(&["a", "b", "c"]))).unwrap();
+        s.close().unwrap();
+
+        let options = Options::default().keep_unrecognized(true);
+        let mut s = Shuffler::new(dir.path(), options, Some(strings(&["a", "b"]))).unwrap();
+        assert_eq!(s.removed_on_load(), 0);
+        assert!(s.take_unrecognized().is_empty());
+        s.close().unwrap();
+
+        let mut s = Shuffler::new_default(dir.path(), Some(strings(&["a"]))).unwrap();
+        assert_eq!(s.removed_on_load(), 2);
+        let mut unrecognized = s.take_unrecognized();
+        unrecognized.sort_unstable();
+        assert_eq!(unrecognized, strings(&["b", "c"]));
+        assert!(s.take_unrecognized().is_empty());
+        s.close().unwrap();
+
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a"]));
+    }
+
+    #[test]
+    fn fallback() {
+        let dir = tempdir().unwrap();
+        let mut s = FallbackShuffler::new(dir.path(), Options::default(), Some(strings(&["a"])));
+        assert!(s.is_persistent());
+        s.add("b".to_owned()).unwrap();
+        s.close().unwrap();
+
+        let s = Shuffler::new_default(dir.path(), None).unwrap();
+        assert_eq!(sorted(&s), strings(&["a", "b"]));
+        s.close().unwrap();
+
+        // A database can't be created inside a file, so the items are kept in memory instead.
+        let file = dir.path().join("file");
+        fs::write(&file, "").unwrap();
+        let mut memory =
+            FallbackShuffler::new(file.join("db"), Options::default(), Some(strings(&["c"])));
+        assert!(!memory.is_persistent());
+        assert!(memory.error().is_some());
+        assert!(memory.check_health().is_err());
+
+        memory.add("d".to_owned()).unwrap();
+        assert_eq!(sorted(&memory), strings(&["c", "d"]));
+        assert!(memory.next().unwrap().is_some());
+        memory.close().unwrap();
+    }
+}
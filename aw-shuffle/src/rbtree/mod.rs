@@ -2,6 +2,7 @@
 
 use std::cmp::{max, min, Ordering};
 use std::hash::{BuildHasher, Hasher};
+use std::marker::PhantomData;
 use std::mem::swap;
 use std::ptr::NonNull;
 
@@ -20,6 +21,8 @@ pub struct Node<T: Item> {
     children: usize,
     min_gen: u64,
     max_gen: u64,
+    // The number of nodes in this subtree with a generation of min_gen.
+    min_count: usize,
     parent: Option<NonNull<Node<T>>>,
     left: Option<NonNull<Node<T>>>,
     right: Option<NonNull<Node<T>>>,
@@ -55,6 +58,7 @@ impl<T: Item + std::fmt::Debug> std::fmt::Debug for Node<T> {
             .field("children", &self.children)
             .field("min_gen", &self.min_gen)
             .field("max_gen", &self.max_gen)
+            .field("min_count", &self.min_count)
             .finish()
     }
 }
@@ -125,12 +129,13 @@ impl<T: Item> Node<T> {
         self.children = 0;
         self.max_gen = self.gen;
         self.min_gen = self.gen;
+        self.min_count = 1;
 
         if let Some(left) = self.left {
             let lb = unsafe { left.as_ref() };
 
             self.children += 1 + lb.children;
-            self.min_gen = min(self.min_gen, lb.min_gen);
+            self.merge_min(lb.min_gen, lb.min_count);
             self.max_gen = max(self.max_gen, lb.max_gen);
         }
 
@@ -138,11 +143,22 @@ impl<T: Item> Node<T> {
             let rb = unsafe { right.as_ref() };
 
             self.children += 1 + rb.children;
-            self.min_gen = min(self.min_gen, rb.min_gen);
+            self.merge_min(rb.min_gen, rb.min_count);
             self.max_gen = max(self.max_gen, rb.max_gen);
         }
     }
 
+    fn merge_min(&mut self, gen: u64, count: usize) {
+        match gen.cmp(&self.min_gen) {
+            Ordering::Less => {
+                self.min_gen = gen;
+                self.min_count = count;
+            }
+            Ordering::Equal => self.min_count += count,
+            Ordering::Greater => {}
+        }
+    }
+
     fn recalc_ancestors(mut node: NonNull<Self>) {
         let mut node = unsafe { node.as_mut() };
         loop {
@@ -154,11 +170,30 @@ impl<T: Item> Node<T> {
         }
     }
 
+    // Changing a generation doesn't change the shape of the tree, so ancestors only need to be
+    // updated until one's range of generations and count of oldest nodes is unaffected. When many
+    // items are selected at once most updates stop well before the root.
+    fn recalc_generations(mut node: NonNull<Self>) {
+        let mut node = unsafe { node.as_mut() };
+        loop {
+            let old = (node.min_gen, node.max_gen, node.min_count);
+            node.recalculate();
+            if (node.min_gen, node.max_gen, node.min_count) == old {
+                break;
+            }
+
+            node = match &mut node.parent {
+                None => break,
+                Some(p) => unsafe { p.as_mut() },
+            };
+        }
+    }
+
     pub(crate) fn set_generation(mut node: NonNull<Self>, next_gen: u64) {
         let n = unsafe { node.as_mut() };
         if n.gen != next_gen {
             n.gen = next_gen;
-            Self::recalc_ancestors(node);
+            Self::recalc_generations(node);
         }
     }
 
@@ -192,6 +227,35 @@ impl<T: Item> Node<T> {
         Err(nb.children + 1)
     }
 
+    // Finds the i-th node, in order, with the minimum generation of the subtree.
+    fn find_oldest(mut node: NonNull<Self>, mut i: usize) -> Option<NonNull<Self>> {
+        let g = unsafe { node.as_ref() }.min_gen;
+
+        loop {
+            let nb = unsafe { node.as_ref() };
+
+            if let Some(left) = nb.left {
+                let lb = unsafe { left.as_ref() };
+                if lb.min_gen == g {
+                    if i < lb.min_count {
+                        node = left;
+                        continue;
+                    }
+                    i -= lb.min_count;
+                }
+            }
+
+            if nb.gen == g {
+                if i == 0 {
+                    return Some(node);
+                }
+                i -= 1;
+            }
+
+            node = nb.right?;
+        }
+    }
+
     fn values<'a>(&'a self, vals: &mut Vec<&'a T>) {
         if let Some(left) = self.left {
             unsafe {
@@ -220,10 +284,28 @@ impl<T: Item> Node<T> {
         }
     }
 
+    fn matching(
+        node: NonNull<Self>,
+        pred: &mut impl FnMut(&T, u64) -> bool,
+        out: &mut Vec<NonNull<Self>>,
+    ) {
+        let nb = unsafe { node.as_ref() };
+        if let Some(left) = nb.left {
+            Self::matching(left, pred, out);
+        }
+        if pred(&nb.item, nb.gen) {
+            out.push(node);
+        }
+        if let Some(right) = nb.right {
+            Self::matching(right, pred, out);
+        }
+    }
+
     fn reset(&mut self) {
         self.gen = 0;
         self.min_gen = 0;
         self.max_gen = 0;
+        self.min_count = self.children + 1;
         unsafe {
             if let Some(mut left) = self.left {
                 left.as_mut().reset();
@@ -276,6 +358,86 @@ impl<T: Item> Node<T> {
             vals.push(node.item);
         }
     }
+
+    // Checks the invariants of the subtree rooted at this node, returning its black height.
+    fn check(&self) -> Result<usize, &'static str> {
+        let mut min_gen = self.gen;
+        let mut max_gen = self.gen;
+        let mut children = 0;
+
+        unsafe {
+            let (l_black, l_red) = if let Some(left) = self.left {
+                let lb = left.as_ref();
+                ensure(lb.parent.map(|p| p.as_ref()) == Some(self), "left child has wrong parent")?;
+                ensure(self.hash >= lb.hash && self > lb, "left child is out of order")?;
+
+                children += lb.children + 1;
+                min_gen = min(min_gen, lb.min_gen);
+                max_gen = max(max_gen, lb.max_gen);
+                (lb.check()?, lb.red)
+            } else {
+                (0, false)
+            };
+
+            let (r_black, r_red) = if let Some(right) = self.right {
+                let rb = right.as_ref();
+                ensure(
+                    rb.parent.map(|p| p.as_ref()) == Some(self),
+                    "right child has wrong parent",
+                )?;
+                ensure(self.hash <= rb.hash && self < rb, "right child is out of order")?;
+
+                children += rb.children + 1;
+                min_gen = min(min_gen, rb.min_gen);
+                max_gen = max(max_gen, rb.max_gen);
+                (rb.check()?, rb.red)
+            } else {
+                (0, false)
+            };
+
+            // red nodes cannot have red children
+            ensure(!self.red || !(l_red || r_red), "red node has a red child")?;
+
+            ensure(self.min_gen == min_gen, "stale minimum generation")?;
+            ensure(self.max_gen == max_gen, "stale maximum generation")?;
+            let oldest = |n: Option<NonNull<Self>>| match n.map(|n| n.as_ref()) {
+                Some(nb) if nb.min_gen == min_gen => nb.min_count,
+                _ => 0,
+            };
+            let min_count =
+                usize::from(self.gen == min_gen) + oldest(self.left) + oldest(self.right);
+            ensure(self.min_count == min_count, "stale count of oldest nodes")?;
+            ensure(self.children == children, "stale child count")?;
+            ensure(l_black == r_black, "unbalanced black height")?;
+
+            Ok(if self.red { l_black } else { l_black + 1 })
+        }
+    }
+}
+
+impl<T: Item + std::fmt::Debug> Node<T> {
+    fn write_debug(&self, f: &mut impl std::fmt::Write, depth: usize) -> std::fmt::Result {
+        if let Some(left) = self.left {
+            unsafe { left.as_ref() }.write_debug(f, depth + 1)?;
+        }
+
+        let c = if self.red { "red" } else { "black" };
+        writeln!(
+            f,
+            "{:indent$}{:?}: {} [{},{}], {c}",
+            "",
+            self.item,
+            self.gen,
+            self.min_gen,
+            self.max_gen,
+            indent = depth * 2
+        )?;
+
+        if let Some(right) = self.right {
+            unsafe { right.as_ref() }.write_debug(f, depth + 1)?;
+        }
+        Ok(())
+    }
 }
 
 // TODO -- it'd be possible to drop the Clone requirement here.
@@ -286,13 +448,25 @@ pub struct Rbtree<T: Item, H: Hasher + Clone> {
     hasher: H,
 }
 
+// SAFETY: The tree exclusively owns every node reachable from root, so moving it to another
+// thread moves the items and hasher with it and leaves no aliases behind.
 unsafe impl<T, H> Send for Rbtree<T, H>
 where
     T: Item + Send,
     H: Hasher + Clone + Send,
 {
 }
-// Implementing Sync would likely be safe but functionally probably useless.
+
+// SAFETY: Every method that writes to nodes, directly or through Node::set_generation on a pointer
+// handed out by find_node or find_next, is only reachable through &mut self on the tree or the
+// shuffler that owns it. Methods taking &self only read nodes, so shared references can't race and
+// only need T and H to be Sync.
+unsafe impl<T, H> Sync for Rbtree<T, H>
+where
+    T: Item + Sync,
+    H: Hasher + Clone + Sync,
+{
+}
 
 impl<T: Item> Default for Rbtree<T, AHasher> {
     fn default() -> Self {
@@ -317,6 +491,50 @@ where
 }
 
 
+// An in-order iterator that follows parent pointers instead of keeping a stack.
+pub struct Iter<'a, T: Item> {
+    next: Option<NonNull<Node<T>>>,
+    remaining: usize,
+    _tree: PhantomData<&'a Node<T>>,
+}
+
+impl<'a, T: Item> Iterator for Iter<'a, T> {
+    type Item = (&'a T, u64);
+
+    fn next(&mut self) -> Option<Self::Item> {
+        // The tree can't be modified while it's borrowed by the iterator.
+        let node = unsafe { self.next?.as_ref() };
+
+        self.next = if let Some(mut n) = node.right {
+            while let Some(left) = unsafe { n.as_ref().left } {
+                n = left;
+            }
+            Some(n)
+        } else {
+            let mut child = node;
+            loop {
+                let Some(parent) = child.parent else {
+                    break None;
+                };
+                let parent = unsafe { parent.as_ref() };
+                if parent.is_left_child(child) {
+                    break Some(NonNull::from(parent));
+                }
+                child = parent;
+            }
+        };
+
+        self.remaining -= 1;
+        Some((&node.item, node.gen))
+    }
+
+    fn size_hint(&self) -> (usize, Option<usize>) {
+        (self.remaining, Some(self.remaining))
+    }
+}
+
+impl<T: Item> ExactSizeIterator for Iter<'_, T> {}
+
 // c - current
 // p - parent
 // g - grandparent
@@ -330,6 +548,10 @@ where
         Self { root: None, size: 0, hasher }
     }
 
+    pub(crate) const fn hasher(&self) -> &H {
+        &self.hasher
+    }
+
     fn hash(&self, item: &T) -> u64 {
         let mut hasher = self.hasher.clone();
         item.hash(&mut hasher);
@@ -369,6 +591,7 @@ where
             children: 0,
             min_gen: gen,
             max_gen: gen,
+            min_count: 1,
             parent: None,
             left: None,
             right: None,
@@ -415,12 +638,8 @@ where
             let pb = unsafe { p.as_mut() };
 
             pb.children += 1;
-
-            if gen > pb.max_gen {
-                pb.max_gen = gen;
-            } else if gen < pb.min_gen {
-                pb.min_gen = gen;
-            }
+            pb.merge_min(gen, 1);
+            pb.max_gen = max(pb.max_gen, gen);
 
             let next = pb.parent;
 
@@ -436,8 +655,26 @@ where
     }
 
     pub fn delete(&mut self, item: &T) -> Option<(T, u64)> {
-        let mut n = self.find_node(item)?;
+        let n = self.find_node(item)?;
+        Some(self.delete_node(n))
+    }
+
+    // Removes every item matching pred, visiting each node once, and returns them in order.
+    pub(crate) fn remove_where(&mut self, mut pred: impl FnMut(&T, u64) -> bool) -> Vec<T> {
+        let mut matched = Vec::new();
+        if let Some(root) = self.root {
+            Node::matching(root, &mut pred, &mut matched);
+        }
+
+        // Deleting a node only frees it or its successor, and only moves items out of larger
+        // nodes, so deleting from the largest down leaves the remaining pointers valid.
+        let mut removed: Vec<_> =
+            matched.into_iter().rev().map(|n| self.delete_node(n).0).collect();
+        removed.reverse();
+        removed
+    }
 
+    fn delete_node(&mut self, mut n: NonNull<Node<T>>) -> (T, u64) {
         self.size -= 1;
 
         let nb = unsafe { n.as_mut() };
@@ -478,7 +715,7 @@ where
             // By now there are no other pointers to n and it can be dropped.
             let n = unsafe { Box::from_raw(n.as_ptr()) };
 
-            return Some((n.item, n.hash));
+            return (n.item, n.hash);
         };
 
         let (c, c_red) = match (nb.left, nb.right) {
@@ -523,7 +760,7 @@ where
         // By now there are no other pointers to n and it can be dropped.
         let n = unsafe { Box::from_raw(n.as_ptr()) };
 
-        Some((n.item, n.hash))
+        (n.item, n.hash)
     }
 
     fn fix_after_insert(&mut self, node: NonNull<Node<T>>) {
@@ -778,6 +1015,37 @@ where
         out
     }
 
+    pub(crate) fn iter(&self) -> Iter<'_, T> {
+        let mut next = self.root;
+        while let Some(left) = next.and_then(|n| unsafe { n.as_ref().left }) {
+            next = Some(left);
+        }
+
+        Iter { next, remaining: self.size(), _tree: PhantomData }
+    }
+
+    // Starts from the first item ordered after `item`, which doesn't need to be in the tree.
+    pub(crate) fn iter_after(&self, item: &T) -> Iter<'_, T> {
+        let h = self.hash(item);
+
+        let mut n = self.root;
+        let mut next = None;
+        let mut skipped = 0;
+
+        while let Some(node) = n {
+            let nb = unsafe { node.as_ref() };
+            if (h, item) < (nb.hash, &nb.item) {
+                next = Some(node);
+                n = nb.left;
+            } else {
+                skipped += nb.left.map_or(0, |l| unsafe { l.as_ref().children } + 1) + 1;
+                n = nb.right;
+            }
+        }
+
+        Iter { next, remaining: self.size() - skipped, _tree: PhantomData }
+    }
+
     pub(crate) fn into_values(mut self) -> Vec<T> {
         let mut out = Vec::with_capacity(self.size);
 
@@ -808,6 +1076,24 @@ where
         }
     }
 
+    // The number of items with the oldest generation.
+    pub(crate) const fn oldest_count(&self) -> usize {
+        if let Some(root) = self.root {
+            unsafe { root.as_ref().min_count }
+        } else {
+            0
+        }
+    }
+
+    // Finds the i-th item, in order, with the oldest generation.
+    #[allow(clippy::missing_panics_doc)]
+    pub(crate) fn find_oldest(&self, i: usize) -> NonNull<Node<T>> {
+        assert!(i < self.oldest_count());
+        let root = self.root.expect("Root cannot be None in a tree with size > 0");
+
+        Node::find_oldest(root, i).expect("Corrupt tree")
+    }
+
     pub(crate) const fn generations(&self) -> (u64, u64) {
         if let Some(root) = self.root {
             let root = unsafe { root.as_ref() };
@@ -816,6 +1102,37 @@ where
             (0, 0)
         }
     }
+
+    // Writes every node in order, indented by depth.
+    pub(crate) fn write_debug(&self, f: &mut impl std::fmt::Write) -> std::fmt::Result
+    where
+        T: std::fmt::Debug,
+    {
+        match self.root {
+            Some(root) => unsafe { root.as_ref() }.write_debug(f, 0),
+            None => Ok(()),
+        }
+    }
+
+    // Checks that the tree is internally consistent. This should never fail unless there's a bug.
+    pub(crate) fn check(&self) -> Result<(), &'static str> {
+        match self.root {
+            None => ensure(self.size == 0, "empty tree has non-zero size"),
+            Some(root) => {
+                let rb = unsafe { root.as_ref() };
+
+                ensure(self.size == rb.children + 1, "tree size does not match its root")?;
+                ensure(rb.parent.is_none(), "root has a parent")?;
+                ensure(!rb.red, "root is red")?;
+
+                rb.check().map(drop)
+            }
+        }
+    }
+}
+
+const fn ensure(cond: bool, err: &'static str) -> Result<(), &'static str> {
+    if cond { Ok(()) } else { Err(err) }
 }
 
 #[cfg(test)]
@@ -861,54 +1178,6 @@ where
 
         format!("({} {} {c} {left} {right})", self.item, self.gen)
     }
-
-    fn verify(&self) -> usize {
-        let mut min_gen = self.gen;
-        let mut max_gen = self.gen;
-        let mut children = 0;
-
-        unsafe {
-            let (l_black, l_red) = if let Some(left) = self.left {
-                let lb = left.as_ref();
-                assert_eq!(self, lb.parent.unwrap().as_ref());
-
-                assert!(self.hash >= lb.hash);
-                assert!(self > lb);
-
-                children += lb.children + 1;
-                min_gen = min(min_gen, lb.min_gen);
-                max_gen = max(max_gen, lb.max_gen);
-                (lb.verify(), lb.red)
-            } else {
-                (0, false)
-            };
-
-            let (r_black, r_red) = if let Some(right) = self.right {
-                let rb = right.as_ref();
-                assert_eq!(self, rb.parent.unwrap().as_ref());
-
-                assert!(self.hash <= rb.hash);
-                assert!(self < rb);
-
-                children += rb.children + 1;
-                min_gen = min(min_gen, rb.min_gen);
-                max_gen = max(max_gen, rb.max_gen);
-                (rb.verify(), rb.red)
-            } else {
-                (0, false)
-            };
-
-            // red nodes cannot have red children
-            assert!(!self.red || !(l_red || r_red));
-
-            assert_eq!(self.min_gen, min_gen);
-            assert_eq!(self.max_gen, max_gen);
-            assert_eq!(self.children, children);
-            assert_eq!(l_black, r_black);
-
-            if self.red { l_black } else { l_black + 1 }
-        }
-    }
 }
 
 #[cfg(test)]
@@ -933,20 +1202,7 @@ where
     }
 
     fn verify(&self) {
-        match self.root {
-            None => {
-                assert_eq!(self.size, 0);
-            }
-            Some(root) => {
-                let rb = unsafe { root.as_ref() };
-
-                assert_eq!(self.size, rb.children + 1);
-                assert!(rb.parent.is_none());
-                assert!(!rb.red);
-
-                rb.verify();
-            }
-        }
+        self.check().unwrap();
     }
 }
 
@@ -960,6 +1216,7 @@ pub mod tests {
 
     use ahash::{AHashMap, RandomState};
     use rand::prelude::SliceRandom;
+    use rand::Rng;
 
     use super::{Node, Rbtree};
 
@@ -1455,6 +1712,33 @@ pub mod tests {
         v.into_iter().zip(expected.iter()).for_each(|(a, b)| assert_eq!(a, b));
     }
 
+    #[test]
+    fn iter() {
+        let strings = sequential_strings(100);
+        let mut rb = Rbtree::default();
+        assert_eq!(rb.iter().next(), None);
+
+        for (i, s) in strings.iter().enumerate() {
+            assert!(rb.insert(s, i as u64));
+        }
+
+        let iter = rb.iter();
+        assert_eq!(iter.len(), 100);
+        assert_eq!(iter.collect::<Vec<_>>(), rb.dump());
+
+        let dump: Vec<_> = rb.dump().into_iter().map(|(s, g)| (*s, g)).collect();
+        for (i, (item, _)) in dump.iter().enumerate() {
+            let after = rb.iter_after(item);
+            assert_eq!(after.len(), 99 - i);
+            assert_eq!(after.map(|(s, g)| (*s, g)).collect::<Vec<_>>(), &dump[i + 1..]);
+        }
+
+        // Items that aren't in the tree still have a position.
+        rb.delete(&dump[50].0).unwrap();
+        let after = rb.iter_after(&dump[50].0);
+        assert_eq!(after.map(|(s, g)| (*s, g)).collect::<Vec<_>>(), &dump[51..]);
+    }
+
     #[test]
     fn into_values() {
         let strings = sequential_strings(10);
@@ -1473,6 +1757,7 @@ pub mod tests {
         v.into_iter().zip(expected.iter()).for_each(|(a, b)| assert_eq!(a, b));
     }
 
+
     #[test]
     fn size() {
         let mut rb = Rbtree::new_dummy(&[]);
@@ -1532,4 +1817,47 @@ pub mod tests {
         assert_eq!(rb.print(), "(5 5 b (2 1000 r  ) (7 7 r  ))");
         rb.verify();
     }
+
+    // Generation updates stop early, so check the ranges stay correct for batches of updates.
+    #[test]
+    fn fuzz_set_generation() {
+        let mut rng = rand::thread_rng();
+        let mut rb = Rbtree::default();
+        for (i, s) in sequential_strings(1000).into_iter().enumerate() {
+            assert!(rb.insert(s, i.try_into().unwrap()));
+        }
+
+        for gen in 1000..1100 {
+            for _ in 0..50 {
+                let min_gen = rb.generations().0;
+                let n = rb.find_next(rng.gen_range(0..rb.size()), rng.gen_range(min_gen..gen));
+                Node::set_generation(n, gen);
+            }
+            rb.verify();
+        }
+    }
+
+    #[test]
+    fn fuzz_remove_where() {
+        let input = sequential_strings(1000);
+        let mut rb = Rbtree::default();
+        for (i, s) in input.iter().enumerate() {
+            assert!(rb.insert(s.clone(), i.try_into().unwrap()));
+        }
+
+        let mut removed = rb.remove_where(|_, gen| gen % 3 == 0);
+        rb.verify();
+        assert_eq!(rb.size(), 666);
+        assert_eq!(removed.len(), 334);
+
+        removed.sort();
+        let mut expected: Vec<_> = input.iter().step_by(3).cloned().collect();
+        expected.sort();
+        assert_eq!(removed, expected);
+
+        assert!(rb.remove_where(|_, _| false).is_empty());
+        assert_eq!(rb.remove_where(|_, _| true).len(), 666);
+        rb.verify();
+        assert_eq!(rb.size(), 0);
+    }
 }
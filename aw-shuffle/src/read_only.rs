@@ -0,0 +1,72 @@
+use crate::AwShuffler;
+
+/// A read-only view of a shuffler that only exposes methods that can't change its state.
+///
+/// This can be handed to code that should be able to inspect a shuffler without selecting,
+/// adding, or removing items.
+#[derive(Debug)]
+pub struct ReadOnly<'a, S: AwShuffler>(&'a S);
+
+impl<S: AwShuffler> Clone for ReadOnly<'_, S> {
+    fn clone(&self) -> Self {
+        *self
+    }
+}
+
+impl<S: AwShuffler> Copy for ReadOnly<'_, S> {}
+
+impl<'a, S: AwShuffler> From<&'a S> for ReadOnly<'a, S> {
+    fn from(shuffler: &'a S) -> Self {
+        Self(shuffler)
+    }
+}
+
+impl<'a, S: AwShuffler> ReadOnly<'a, S> {
+    /// Creates a read-only view of `shuffler`.
+    pub const fn new(shuffler: &'a S) -> Self {
+        Self(shuffler)
+    }
+
+    /// See [`AwShuffler::size`].
+    pub fn size(&self) -> usize {
+        self.0.size()
+    }
+
+    /// See [`AwShuffler::contains`].
+    pub fn contains(&self, item: &S::Item) -> bool {
+        self.0.contains(item)
+    }
+
+    /// See [`AwShuffler::values`].
+    pub fn values(&self) -> Vec<&'a S::Item> {
+        self.0.values()
+    }
+
+    /// See [`AwShuffler::dump`].
+    pub fn dump(&self) -> Vec<(&'a S::Item, u64)> {
+        self.0.dump()
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{InfallibleShuffler, Shuffler};
+
+    #[test]
+    fn read_only() {
+        let mut shuffler = Shuffler::default();
+        shuffler.inf_add("a");
+        shuffler.inf_add("b");
+
+        let view = ReadOnly::new(&shuffler);
+        assert_eq!(view.size(), 2);
+        assert!(view.contains(&"a"));
+        assert!(!view.contains(&"c"));
+
+        let mut values = view.values();
+        values.sort_unstable();
+        assert_eq!(values, vec![&"a", &"b"]);
+    }
+}
@@ -0,0 +1,121 @@
+// The system clock can't be read in browsers.
+#[cfg(not(all(target_arch = "wasm32", target_os = "unknown")))]
+use std::time::{Duration, SystemTime};
+
+/// A schedule for changing a shuffler's bias automatically, either as items are selected or as
+/// time passes. See
+/// [`ShufflerGeneric::set_bias_schedule`](crate::ShufflerGeneric::set_bias_schedule).
+///
+/// The schedule is a list of points. Between two points the bias changes linearly, and before the
+/// first point or after the last point it stays at that point's bias. If either point has an
+/// infinite bias the earlier bias is kept until the later point is reached.
+#[derive(Debug, Clone)]
+pub struct BiasSchedule {
+    clock: Clock,
+    // The x values are numbers of selections or seconds.
+    points: Vec<(f64, f64)>,
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Clock {
+    Selections,
+    #[cfg(not(all(target_arch = "wasm32", target_os = "unknown")))]
+    Since(SystemTime),
+}
+
+impl BiasSchedule {
+    /// Creates a schedule based on the number of items selected since the schedule was set.
+    /// Each item counts separately, so [`next_n`](crate::AwShuffler::next_n) counts as `n`
+    /// selections.
+    ///
+    /// # Panics
+    /// Panics if `points` is empty, the numbers of selections are not increasing, or any bias is
+    /// negative or NaN.
+    #[must_use]
+    pub fn by_selections(points: impl IntoIterator<Item = (u64, f64)>) -> Self {
+        Self::new(Clock::Selections, points.into_iter().map(|(n, b)| (n as f64, b)).collect())
+    }
+
+    /// Creates a schedule based on the time elapsed since `start`, such as when a batch of items
+    /// was imported. This does not depend on when the schedule was set, so it can be reused
+    /// between runs.
+    ///
+    /// Not available on `wasm32-unknown-unknown`, where the system clock can't be read.
+    ///
+    /// # Panics
+    /// Panics if `points` is empty, the durations are not increasing, or any bias is negative or
+    /// NaN.
+    #[must_use]
+    #[cfg(not(all(target_arch = "wasm32", target_os = "unknown")))]
+    pub fn by_time(start: SystemTime, points: impl IntoIterator<Item = (Duration, f64)>) -> Self {
+        let points = points.into_iter().map(|(d, b)| (d.as_secs_f64(), b)).collect();
+        Self::new(Clock::Since(start), points)
+    }
+
+    fn new(clock: Clock, points: Vec<(f64, f64)>) -> Self {
+        assert!(!points.is_empty(), "bias schedule cannot be empty.");
+        assert!(points.windows(2).all(|w| w[0].0 < w[1].0), "bias schedule must be increasing.");
+
+        for (_, bias) in &points {
+            assert!(!bias.is_nan(), "bias {bias} cannot be NaN.");
+            assert!(bias.is_sign_positive(), "bias {bias} cannot be negative.");
+        }
+
+        Self { clock, points }
+    }
+
+    pub(crate) fn bias(&self, selections: u64) -> f64 {
+        let x = match self.clock {
+            Clock::Selections => selections as f64,
+            // A clock set to before start is treated as being at start.
+            #[cfg(not(all(target_arch = "wasm32", target_os = "unknown")))]
+            Clock::Since(start) => start.elapsed().unwrap_or_default().as_secs_f64(),
+        };
+
+        let next = self.points.partition_point(|(px, _)| *px <= x);
+        if next == 0 {
+            return self.points[0].1;
+        }
+
+        let (x0, b0) = self.points[next - 1];
+        let Some(&(x1, b1)) = self.points.get(next) else {
+            return b0;
+        };
+
+        if b0.is_infinite() || b1.is_infinite() {
+            return b0;
+        }
+
+        b0 + (b1 - b0) * (x - x0) / (x1 - x0)
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn interpolate() {
+        let s = BiasSchedule::by_selections([(10, 4.0), (20, 2.0), (30, f64::INFINITY)]);
+
+        assert_eq!(s.bias(0), 4.0);
+        assert_eq!(s.bias(10), 4.0);
+        assert_eq!(s.bias(15), 3.0);
+        assert_eq!(s.bias(25), 2.0);
+        assert_eq!(s.bias(30), f64::INFINITY);
+        assert_eq!(s.bias(100), f64::INFINITY);
+    }
+
+    #[test]
+    fn by_time() {
+        let start = SystemTime::now() - Duration::from_secs(50);
+        let s =
+            BiasSchedule::by_time(start, [(Duration::ZERO, 10.0), (Duration::from_secs(10), 2.0)]);
+        assert_eq!(s.bias(0), 2.0);
+
+        let future = SystemTime::now() + Duration::from_secs(1000);
+        let s = BiasSchedule::by_time(future, [(Duration::from_secs(1), 5.0)]);
+        assert_eq!(s.bias(0), 5.0);
+    }
+}
@@ -0,0 +1,22 @@
+use crate::{BiasSchedule, NewItemHandling};
+
+/// The tunable settings of a shuffler, for applying the same configuration to many shufflers.
+/// See [`ShufflerGeneric::settings`](crate::ShufflerGeneric::settings).
+///
+/// Weight functions can't be copied and are not included. More settings may be added in the
+/// future, so this can only be created by reading it from a shuffler.
+#[derive(Debug, Clone)]
+#[non_exhaustive]
+pub struct Settings {
+    /// See [`ShufflerGeneric::set_bias`](crate::ShufflerGeneric::set_bias). When there is a
+    /// schedule this is the current bias from the schedule and is replaced when the settings are
+    /// applied.
+    pub bias: f64,
+    /// See [`Shuffler::new`](crate::Shuffler::new).
+    pub new_item_handling: NewItemHandling,
+    /// See [`ShufflerGeneric::set_bias_schedule`](crate::ShufflerGeneric::set_bias_schedule).
+    /// Schedules based on selections restart from the beginning when applied.
+    pub bias_schedule: Option<BiasSchedule>,
+    /// See [`ShufflerGeneric::set_strict_rotation`](crate::ShufflerGeneric::set_strict_rotation).
+    pub strict_rotation: bool,
+}
@@ -0,0 +1,373 @@
+//! Helpers for testing code that uses shufflers without real randomness or a database.
+use std::collections::VecDeque;
+use std::fmt;
+
+use rand::RngCore;
+
+use crate::{AwShuffler, Item};
+
+/// A random number generator that cycles through a fixed sequence of values, for use with
+/// [`ShufflerGeneric::new_custom`](crate::ShufflerGeneric::new_custom) to get reproducible
+/// selections in tests.
+///
+/// An empty sequence always produces 0. How the values map to selections is an implementation
+/// detail of the shufflers and may change between versions.
+#[derive(Debug, Default, Clone)]
+pub struct SequenceRng {
+    vals: Vec<u64>,
+    index: usize,
+}
+
+impl SequenceRng {
+    /// Creates a SequenceRng that returns `vals` in order, starting over after the last one.
+    #[must_use]
+    pub const fn new(vals: Vec<u64>) -> Self {
+        Self { vals, index: 0 }
+    }
+}
+
+impl RngCore for SequenceRng {
+    fn next_u32(&mut self) -> u32 {
+        self.next_u64() as u32
+    }
+
+    fn next_u64(&mut self) -> u64 {
+        if self.vals.is_empty() {
+            return 0;
+        }
+        let v = self.vals[self.index];
+        self.index = (self.index + 1) % self.vals.len();
+        v
+    }
+
+    fn fill_bytes(&mut self, dest: &mut [u8]) {
+        for chunk in dest.chunks_mut(8) {
+            let bytes = self.next_u64().to_le_bytes();
+            chunk.copy_from_slice(&bytes[..chunk.len()]);
+        }
+    }
+
+    fn try_fill_bytes(&mut self, dest: &mut [u8]) -> Result<(), rand::Error> {
+        self.fill_bytes(dest);
+        Ok(())
+    }
+}
+
+/// The error returned by [`ScriptedShuffler`] when a failure has been injected.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct InjectedError;
+
+impl fmt::Display for InjectedError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("injected failure")
+    }
+}
+
+impl std::error::Error for InjectedError {}
+
+#[derive(Debug)]
+enum Step<T> {
+    Select(Vec<T>),
+    Fail,
+}
+
+/// A deterministic shuffler that returns pre-programmed selections and can be told to fail.
+///
+/// Scripted steps are consumed in order. A selection step is used by the next call to
+/// [`next`](AwShuffler::next), [`next_n`](AwShuffler::next_n), or
+/// [`unique_n`](AwShuffler::unique_n), which return its items as-is. A failure step makes the
+/// next fallible call of any kind return [`InjectedError`] without doing anything.
+///
+/// When the script is empty, items are selected in order of how recently they were selected,
+/// breaking ties by the order they were added, so tests don't need to script every selection.
+///
+/// Selections still respect the documented edge cases of [`AwShuffler`], so an empty shuffler
+/// returns `Ok(None)` without consuming a scripted selection.
+#[derive(Debug)]
+pub struct ScriptedShuffler<T: Item> {
+    // Items and their generations, in the order they were added.
+    items: Vec<(T, u64)>,
+    script: VecDeque<Step<T>>,
+    generation: u64,
+}
+
+impl<T: Item> Default for ScriptedShuffler<T> {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl<T: Item> ScriptedShuffler<T> {
+    /// Creates an empty ScriptedShuffler with an empty script.
+    #[must_use]
+    pub const fn new() -> Self {
+        Self { items: Vec::new(), script: VecDeque::new(), generation: 0 }
+    }
+
+    /// Queues a selection of `items`. The next call to `next` returns the first item, while
+    /// `next_n` and `unique_n` return all of them regardless of `n`.
+    ///
+    /// The items must be present in the shuffler when the selection is made.
+    pub fn select(&mut self, items: impl IntoIterator<Item = T>) -> &mut Self {
+        self.script.push_back(Step::Select(items.into_iter().collect()));
+        self
+    }
+
+    /// Queues a failure for the next fallible call.
+    pub fn fail(&mut self) -> &mut Self {
+        self.script.push_back(Step::Fail);
+        self
+    }
+
+    /// Returns the number of steps left in the script.
+    pub fn remaining(&self) -> usize {
+        self.script.len()
+    }
+
+    fn check_failure(&mut self) -> Result<(), InjectedError> {
+        if matches!(self.script.front(), Some(Step::Fail)) {
+            self.script.pop_front();
+            return Err(InjectedError);
+        }
+        Ok(())
+    }
+
+    fn position(&self, item: &T) -> Option<usize> {
+        self.items.iter().position(|(i, _)| i == item)
+    }
+
+    // Selects `n` indices, preferring the script, and marks them as selected together.
+    fn select_indices(&mut self, n: usize, unique: bool) -> Vec<usize> {
+        let indices: Vec<_> = if let Some(Step::Select(_)) = self.script.front() {
+            let Some(Step::Select(items)) = self.script.pop_front() else { unreachable!() };
+
+            items
+                .iter()
+                .map(|item| self.position(item).expect("scripted items must be in the shuffler"))
+                .collect()
+        } else {
+            let mut order: Vec<_> = (0..self.items.len()).collect();
+            order.sort_by_key(|&i| self.items[i].1);
+
+            if unique {
+                order.into_iter().take(n).collect()
+            } else {
+                order.into_iter().cycle().take(n).collect()
+            }
+        };
+
+        self.generation += 1;
+        for &i in &indices {
+            self.items[i].1 = self.generation;
+        }
+        indices
+    }
+}
+
+impl<T: Item> AwShuffler for ScriptedShuffler<T> {
+    type Error = InjectedError;
+    type Item = T;
+
+    fn add(&mut self, item: T) -> Result<bool, InjectedError> {
+        self.check_failure()?;
+
+        if self.position(&item).is_some() {
+            return Ok(false);
+        }
+
+        self.items.push((item, 0));
+        Ok(true)
+    }
+
+    fn remove(&mut self, item: &T) -> Result<Option<T>, InjectedError> {
+        self.check_failure()?;
+        Ok(self.position(item).map(|i| self.items.remove(i).0))
+    }
+
+    fn next(&mut self) -> Result<Option<&T>, InjectedError> {
+        self.check_failure()?;
+
+        if self.items.is_empty() {
+            return Ok(None);
+        }
+
+        let indices = self.select_indices(1, true);
+        Ok(indices.first().map(|&i| &self.items[i].0))
+    }
+
+    fn next_n(&mut self, n: usize) -> Result<Option<Vec<&T>>, InjectedError> {
+        self.check_failure()?;
+
+        if self.items.is_empty() {
+            return Ok(None);
+        }
+
+        let indices = self.select_indices(n, false);
+        Ok(Some(indices.into_iter().map(|i| &self.items[i].0).collect()))
+    }
+
+    fn unique_n(&mut self, n: usize) -> Result<Option<Vec<&T>>, InjectedError> {
+        self.check_failure()?;
+
+        if self.items.is_empty() || self.items.len() < n {
+            return Ok(None);
+        }
+
+        let indices = self.select_indices(n, true);
+        Ok(Some(indices.into_iter().map(|i| &self.items[i].0).collect()))
+    }
+
+    fn size(&self) -> usize {
+        self.items.len()
+    }
+
+    fn contains(&self, item: &T) -> bool {
+        self.position(item).is_some()
+    }
+
+    fn values(&self) -> Vec<&T> {
+        self.items.iter().map(|(i, _)| i).collect()
+    }
+
+    fn into_values(self) -> Vec<T> {
+        self.items.into_iter().map(|(i, _)| i).collect()
+    }
+
+    fn dump(&self) -> Vec<(&T, u64)> {
+        self.items.iter().map(|(i, g)| (i, *g)).collect()
+    }
+}
+
+impl<T: Item> crate::private::Sealed for ScriptedShuffler<T> {}
+
+impl<T: Item> crate::private::MarkSelected for ScriptedShuffler<T> {
+    fn mark_selected(&mut self, items: &[&T]) -> Result<(), InjectedError> {
+        self.check_failure()?;
+
+        self.generation += 1;
+        for item in items {
+            if let Some(i) = self.position(item) {
+                self.items[i].1 = self.generation;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Checks that shufflers created by `new` follow the documented behaviour of [`AwShuffler`], so
+/// wrappers and alternative configurations can be verified against the built-in shufflers.
+///
+/// `new` must return an empty shuffler each time it is called, and `item` must return distinct
+/// items for distinct inputs. This covers adding and removing items, the edge cases where
+/// selections return `Ok(None)`, uniqueness, and that items selected together share the newest
+/// generation.
+///
+/// # Panics
+/// Panics with a description of the first violation found, or if the shuffler returns an error.
+pub fn check_conformance<S: AwShuffler>(mut new: impl FnMut() -> S, item: impl Fn(u32) -> S::Item) {
+    let mut s = new();
+    assert_eq!(s.size(), 0, "new shufflers must be empty");
+    assert!(s.next().unwrap().is_none(), "next must return None when empty");
+    assert!(s.next_n(0).unwrap().is_none(), "next_n must return None when empty, even for 0");
+    assert!(s.unique_n(0).unwrap().is_none(), "unique_n must return None when empty, even for 0");
+    assert!(s.try_unique_n(1).unwrap().is_none(), "try_unique_n must return None when empty");
+    assert!(s.unique_up_to_n(1).unwrap().is_none(), "unique_up_to_n must return None when empty");
+
+    for i in 0..10 {
+        assert!(s.add(item(i)).unwrap(), "add must return true for new items");
+    }
+    assert!(!s.add(item(0)).unwrap(), "add must return false for items already present");
+    assert_eq!(s.size(), 10, "size must count each item once");
+    assert_eq!(s.values().len(), 10, "values must return every item");
+    assert_eq!(s.dump().len(), 10, "dump must return every item");
+    assert!(s.contains(&item(9)), "contains must find added items");
+
+    assert!(s.remove(&item(9)).unwrap().is_some(), "remove must return removed items");
+    assert!(s.remove(&item(9)).unwrap().is_none(), "remove must return None for missing items");
+    assert!(!s.contains(&item(9)), "contains must not find removed items");
+    assert_eq!(s.size(), 9, "size must not count removed items");
+
+    assert!(s.next().unwrap().is_some(), "next must select from non-empty shufflers");
+    assert_eq!(newest(&s), 1, "next must give the selected item the newest generation");
+
+    assert_eq!(s.next_n(20).unwrap().map(|v| v.len()), Some(20), "next_n must return n items");
+    assert!(s.unique_n(10).unwrap().is_none(), "unique_n must return None without enough items");
+    assert_eq!(
+        s.try_unique_n(10).unwrap().map(|v| v.len()),
+        Some(10),
+        "try_unique_n must fall back to next_n"
+    );
+    let up_to = s.unique_up_to_n(10).unwrap().expect("unique_up_to_n must return items");
+    assert_eq!(up_to.items.len(), 9, "unique_up_to_n must return every item when short");
+    assert_eq!(up_to.short_by, 1, "unique_up_to_n must report how many items it was short by");
+
+    let mut unique = s.unique_n(9).unwrap().expect("unique_n must succeed with enough items");
+    unique.sort_unstable();
+    unique.dedup();
+    assert_eq!(unique.len(), 9, "unique_n must not repeat items");
+
+    s.unique_n(3).unwrap().unwrap();
+    assert_eq!(newest(&s), 3, "items selected together must share the newest generation");
+
+    let values = s.into_values();
+    assert_eq!(values.len(), 9, "into_values must return every item");
+
+    assert_eq!(new().size(), 0, "new must return an empty shuffler each time");
+}
+
+// The number of items with the newest generation.
+fn newest<S: AwShuffler>(s: &S) -> usize {
+    let dump = s.dump();
+    let max = dump.iter().map(|(_, g)| *g).max();
+    dump.iter().filter(|(_, g)| Some(*g) == max).count()
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn script() {
+        let mut s = ScriptedShuffler::new();
+        for i in 0..3 {
+            s.add(i).unwrap();
+        }
+
+        s.select([2]).fail().select([1, 1]);
+
+        assert_eq!(s.next().unwrap(), Some(&2));
+        assert_eq!(s.add(3), Err(InjectedError));
+        assert_eq!(s.next_n(5).unwrap(), Some(vec![&1, &1]));
+        assert_eq!(s.remaining(), 0);
+
+        // Least recently selected first, then in the order they were added.
+        assert_eq!(s.unique_n(2).unwrap(), Some(vec![&0, &2]));
+        assert_eq!(s.next().unwrap(), Some(&1));
+        assert_eq!(s.unique_n(4).unwrap(), None);
+    }
+
+    #[test]
+    fn conformance() {
+        check_conformance(crate::Shuffler::default, |i| i);
+        check_conformance(ScriptedShuffler::new, |i| i.to_string());
+    }
+
+    #[cfg(feature = "rocks")]
+    #[test]
+    fn rocks_conformance() {
+        use crate::persistent::rocksdb::Shuffler;
+
+        // Every shuffler gets a fresh database, kept until all of them have been dropped.
+        let mut dirs = Vec::new();
+        check_conformance(
+            || {
+                let dir = tempfile::tempdir().unwrap();
+                let shuffler = Shuffler::new_default(dir.path(), None).unwrap();
+                dirs.push(dir);
+                shuffler
+            },
+            |i| i,
+        );
+    }
+}
@@ -0,0 +1,52 @@
+use std::time::{Duration, Instant};
+
+use aw_shuffle::persistent::rocksdb::Shuffler;
+use aw_shuffle::persistent::PersistentShuffler;
+use aw_shuffle::AwShuffler;
+use tempfile::tempdir;
+
+use crate::error::OrExit;
+
+// A typical number of strings to request at once from pick.
+const UNIQUE_N: usize = 10;
+
+pub fn bench(num: usize) {
+    let tdir = tempdir().or_exit("Failed to create a temporary directory");
+    let keys: Vec<_> = (0..num).map(|i| format!("strpick-bench-{i:010}")).collect();
+
+    let mut s: Shuffler<String> =
+        Shuffler::new_default(tdir.path(), None).or_exit("Failed to open the benchmark database");
+
+    let start = Instant::now();
+    for k in &keys {
+        s.add(k.clone()).or_exit("Failed to write to the database");
+    }
+    report("add", num, start.elapsed());
+
+    let start = Instant::now();
+    for _ in 0..num {
+        s.next().or_exit("Failed to write to the database");
+    }
+    report("next", num, start.elapsed());
+
+    let rounds = (num / UNIQUE_N).max(1);
+    let start = Instant::now();
+    for _ in 0..rounds {
+        s.unique_n(UNIQUE_N.min(num)).or_exit("Failed to write to the database");
+    }
+    report(&format!("unique_n({UNIQUE_N})"), rounds, start.elapsed());
+
+    s.close().or_exit("Failed to close the database");
+
+    let start = Instant::now();
+    let s: Shuffler<String> = Shuffler::new_default(tdir.path(), Some(keys))
+        .or_exit("Failed to reopen the benchmark database");
+    report("load", num, start.elapsed());
+
+    s.close().or_exit("Failed to close the database");
+}
+
+fn report(op: &str, count: usize, elapsed: Duration) {
+    let rate = count as f64 / elapsed.as_secs_f64();
+    println!("{op:<14} {count:>10} ops in {elapsed:>12.3?} ({rate:.0} ops/s)");
+}
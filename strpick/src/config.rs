@@ -0,0 +1,75 @@
+use std::io::ErrorKind;
+use std::path::{Path, PathBuf};
+use std::{env, fs};
+
+use serde::Deserialize;
+
+use crate::error::{fail, Exit};
+use crate::Format;
+
+/// Defaults read from the config file. Anything set on the command line takes priority.
+#[derive(Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct Config {
+    pub db: Option<PathBuf>,
+    pub bias: Option<f64>,
+    pub keep_missing: bool,
+    pub distribute_new: bool,
+    pub null: bool,
+    pub json: bool,
+    pub format: Option<Format>,
+    pub log: Option<PathBuf>,
+    pub root: Option<PathBuf>,
+}
+
+impl Config {
+    /// $XDG_CONFIG_HOME/strpick/config.toml, falling back to ~/.config/strpick/config.toml.
+    pub fn default_path() -> Option<PathBuf> {
+        env::var_os("XDG_CONFIG_HOME")
+            .filter(|d| !d.is_empty())
+            .map(PathBuf::from)
+            .or_else(|| env::var_os("HOME").map(|h| Path::new(&h).join(".config")))
+            .map(|d| d.join("strpick").join("config.toml"))
+    }
+
+    /// $XDG_DATA_HOME/strpick/NAME, falling back to ~/.local/share/strpick/NAME.
+    pub fn named_db(name: &str) -> Option<PathBuf> {
+        env::var_os("XDG_DATA_HOME")
+            .filter(|d| !d.is_empty())
+            .map(PathBuf::from)
+            .or_else(|| env::var_os("HOME").map(|h| Path::new(&h).join(".local").join("share")))
+            .map(|d| d.join("strpick").join(name))
+    }
+
+    /// Loads the config from `path`, or the default path if it is None. It's only an error for the
+    /// file to be missing if it was explicitly requested.
+    pub fn load(path: Option<&Path>) -> Self {
+        Self::try_load(path).unwrap_or_else(|e| fail(Exit::Usage, e))
+    }
+
+    /// Like [`load`](Self::load), but returns errors instead of exiting, for reloading while
+    /// running.
+    pub fn try_load(path: Option<&Path>) -> Result<Self, String> {
+        let (path, required) = match path {
+            Some(p) => (p.to_owned(), true),
+            None => match Self::default_path() {
+                Some(p) => (p, false),
+                None => return Ok(Self::default()),
+            },
+        };
+
+        let contents = match fs::read_to_string(&path) {
+            Ok(c) => c,
+            Err(e) if !required && e.kind() == ErrorKind::NotFound => return Ok(Self::default()),
+            Err(e) => return Err(format!("Failed to read config file {path:?}: {e}")),
+        };
+
+        let config: Self =
+            toml::from_str(&contents).map_err(|e| format!("Invalid config file {path:?}: {e}"))?;
+
+        if config.bias.is_some_and(|b| b.is_nan() || b.is_sign_negative()) {
+            return Err(format!("Invalid bias in config file {path:?}"));
+        }
+        Ok(config)
+    }
+}
@@ -0,0 +1,91 @@
+use std::fmt::Display;
+use std::io;
+use std::num::ParseIntError;
+use std::process;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+use rocksdb::ErrorKind;
+
+static QUIET: AtomicBool = AtomicBool::new(false);
+
+/// The exit status for each class of failure. Clap also exits with 2 for invalid arguments.
+#[derive(Clone, Copy)]
+pub enum Exit {
+    Failure = 1,
+    Usage = 2,
+    Locked = 3,
+    Corrupt = 4,
+}
+
+pub fn set_quiet(quiet: bool) {
+    QUIET.store(quiet, Ordering::Relaxed);
+}
+
+// Prints a problem that doesn't stop the command on its own.
+pub fn report(msg: impl Display) {
+    if !QUIET.load(Ordering::Relaxed) {
+        eprintln!("strpick: {msg}");
+    }
+}
+
+pub fn fail(exit: Exit, msg: impl Display) -> ! {
+    if !QUIET.load(Ordering::Relaxed) {
+        eprintln!("strpick: {msg}");
+    }
+    process::exit(exit as i32)
+}
+
+pub trait Classify: Display {
+    fn exit(&self) -> Exit {
+        Exit::Failure
+    }
+}
+
+impl Classify for rocksdb::Error {
+    fn exit(&self) -> Exit {
+        match self.kind() {
+            ErrorKind::Corruption => Exit::Corrupt,
+            // RocksDB reports another process holding the lock as a generic IO error.
+            ErrorKind::IOError if self.as_ref().contains("lock") => Exit::Locked,
+            _ => Exit::Failure,
+        }
+    }
+}
+
+impl Classify for aw_shuffle::persistent::rocksdb::Error {
+    fn exit(&self) -> Exit {
+        match self {
+            Self::DB(e) => e.exit(),
+            Self::Deserialization(_) => Exit::Corrupt,
+            _ => Exit::Failure,
+        }
+    }
+}
+
+impl Classify for io::Error {}
+
+impl Classify for ParseIntError {}
+
+impl Classify for rmpv::decode::Error {
+    fn exit(&self) -> Exit {
+        Exit::Corrupt
+    }
+}
+
+impl Classify for globset::Error {
+    fn exit(&self) -> Exit {
+        Exit::Usage
+    }
+}
+
+impl Classify for Box<dyn std::error::Error + Send + Sync> {}
+
+pub trait OrExit<T> {
+    fn or_exit(self, context: impl Display) -> T;
+}
+
+impl<T, E: Classify> OrExit<T> for Result<T, E> {
+    fn or_exit(self, context: impl Display) -> T {
+        self.unwrap_or_else(|e| fail(e.exit(), format_args!("{context}: {e}")))
+    }
+}
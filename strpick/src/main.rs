@@ -1,22 +1,136 @@
+use std::borrow::Cow;
 use std::cmp::max;
-use std::io::BufRead;
+use std::collections::HashSet;
+use std::fs::{self, File};
+use std::io::{BufRead, BufReader, BufWriter, Write};
+use std::iter;
 use std::path::{Path, PathBuf};
+use std::process;
+use std::slice;
+use std::sync::mpsc::{self, Sender};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime};
 use std::{io, usize};
 
 use aw_shuffle::persistent::rocksdb::Shuffler;
-use aw_shuffle::persistent::PersistentShuffler;
-use aw_shuffle::AwShuffler;
-use clap::{Parser, Subcommand};
-use rocksdb::{Options, DB};
+use aw_shuffle::persistent::{Options as ShufflerOptions, PersistentShuffler};
+use aw_shuffle::{AwShuffler, InfallibleShuffler, MultiShuffler, NewItemHandling};
+use clap::error::ErrorKind;
+use clap::{CommandFactory, Parser, Subcommand, ValueEnum, ValueHint};
+use clap_complete::Shell;
+use config::Config;
+use error::{fail, report, Classify, Exit, OrExit};
+use globset::{Glob, GlobSet, GlobSetBuilder};
+use oplog::Op;
+use regex::Regex;
+use rocksdb::{Options, WriteBatch, DB};
+use serde::Deserialize;
+use serde_json::json;
+use serve::Source;
 use tempfile::tempdir;
+use template::Template;
 use unicode_width::UnicodeWidthStr;
 
+mod bench;
+mod config;
+mod error;
+mod oplog;
+mod remote;
+mod serve;
+mod snapshot;
+mod template;
+
+const LOCK_RETRY_INTERVAL: Duration = Duration::from_millis(100);
+// aw-shuffle keeps the keys of soft removed strings in this column family when they are persisted.
+const SOFT_REMOVED: &str = "soft_removed";
+
 #[derive(clap::Parser)]
 #[command(name = "strpick", about = "Selects random strings from stdin.")]
 struct Opt {
-    #[arg(long, value_parser)]
+    #[arg(long, value_parser, value_hint = ValueHint::DirPath)]
     /// The RocksDB database used for storing persistent data between runs.
-    db: PathBuf,
+    ///
+    /// Defaults to the database in the config file, or --name. Pick can be given multiple
+    /// databases to pick from all of them, in proportion to how many strings each holds, and
+    /// serve can be given multiple databases to serve them separately.
+    db: Vec<PathBuf>,
+
+    #[arg(long, conflicts_with_all = ["db", "no_db"])]
+    /// Use the database NAME under $XDG_DATA_HOME/strpick instead of --db, so separate uses don't
+    /// need to pick paths or share a database. Defaults to "default" when no database is set.
+    name: Option<String>,
+
+    #[arg(long, conflicts_with = "db")]
+    /// Pick without a database, ignoring history. Only supported by pick and dir.
+    no_db: bool,
+
+    #[arg(long)]
+    /// How strongly to favour strings that haven't been picked recently. Must be non-negative.
+    /// Defaults to 2.0.
+    bias: Option<f64>,
+
+    #[arg(long)]
+    /// Seed the random number generator to make picks reproducible. Picks will only be the same
+    /// when starting from the same database with the same input.
+    seed: Option<u64>,
+
+    #[arg(long)]
+    /// Keep strings that are missing from the input in the database instead of removing them, so
+    /// they keep their history if they come back, such as files on an unmounted drive.
+    keep_missing: bool,
+
+    #[arg(long)]
+    /// Give new strings random generations instead of treating them as never picked, so adding a
+    /// large batch doesn't make the next picks come only from the new strings.
+    distribute_new: bool,
+
+    #[arg(short = '0', long)]
+    /// Read strings separated by NUL characters instead of newlines.
+    null: bool,
+
+    #[arg(long)]
+    /// Print output as JSON instead of plain text.
+    json: bool,
+
+    #[arg(long, value_parser = Template::parse)]
+    /// Print each picked or dumped string using this template instead, replacing {key} and
+    /// {generation}. The escapes \t, \n, \0, \\ and \{ are supported.
+    template: Option<Template>,
+
+    #[arg(long, value_parser = humantime::parse_duration)]
+    /// If another process has the database locked, keep retrying for up to this long, such as
+    /// "10s" or "5m", instead of failing immediately.
+    wait_lock: Option<Duration>,
+
+    #[arg(long, value_hint = ValueHint::FilePath)]
+    /// Append each string that is picked, added, removed, or renamed to this file as JSON lines,
+    /// so the database can be audited or rebuilt with the replay command.
+    log: Option<PathBuf>,
+
+    #[arg(long, value_hint = ValueHint::DirPath)]
+    /// Store strings that are paths under this directory relative to it, and join picked strings
+    /// back onto it, so the database stays valid when the files are moved or mounted elsewhere.
+    /// Dir and watch-dir always store paths relative to their PATH instead.
+    root: Option<PathBuf>,
+
+    #[arg(long, conflicts_with = "no_db")]
+    /// Pick from a database shared by "strpick serve" at this address instead of opening one.
+    /// Strings read from stdin are added to it first. Only supported by pick.
+    remote: Option<String>,
+
+    #[arg(long, requires = "remote")]
+    /// The token to send to --remote, matching the server's --token.
+    remote_token: Option<String>,
+
+    #[arg(short, long)]
+    /// Don't print error messages. The exit status is 1 for general failures, 2 for invalid
+    /// arguments or config, 3 if the database is locked by another process, and 4 if the database
+    /// is corrupt.
+    quiet: bool,
+
+    #[arg(long, value_parser, value_hint = ValueHint::FilePath)]
+    /// The config file to read defaults from. Defaults to $XDG_CONFIG_HOME/strpick/config.toml.
+    config: Option<PathBuf>,
 
     #[command(subcommand)]
     cmd: Command,
@@ -26,65 +140,798 @@ struct Opt {
 enum Command {
     /// Read strings from stdin and pick NUM of them, attempting to make them unique.
     /// If no strings are provided the DB will be read as-is.
-    Pick { num: usize },
+    Pick {
+        num: usize,
+        #[arg(long)]
+        /// Remove the picked strings from the database as they are printed, using it as a queue.
+        consume: bool,
+        #[command(flatten)]
+        filters: Filters,
+    },
+    /// Read strings from stdin then pick one every INTERVAL, keeping the database open. Each
+    /// string is printed, or passed as the final argument to CMD if it is given.
+    /// If no strings are provided the DB will be read as-is.
+    Loop {
+        #[arg(long, value_parser = humantime::parse_duration)]
+        /// How long to wait between picks, such as "30s" or "1h 30m".
+        interval: Duration,
+        #[arg(trailing_var_arg = true, allow_hyphen_values = true)]
+        cmd: Vec<String>,
+        #[command(flatten)]
+        filters: Filters,
+    },
     /// Dump the current contents of the database to stdout.
     /// This will work on any aw-shuffler databases that store strings.
-    Dump,
+    Dump(DumpArgs),
     /// Dump the contents of any valid aw-shuffler database.
-    DumpRaw,
+    DumpRaw(DumpArgs),
     /// Repair an existing database if rocksdb has corrupted itself.
     Repair,
+    /// Compact the database to reclaim disk space, such as after removing many strings.
+    Compact,
+    /// Check that every record in the database can be decoded and that the loaded shuffler is
+    /// consistent. Problems are printed to stderr and the exit status is 4 if any are found.
+    Verify,
+    /// Keep the database open and synchronized with the strings in FILE, re-reading it whenever
+    /// it changes or on SIGHUP. New strings are added and vanished strings are soft removed,
+    /// keeping their history in the database.
+    ///
+    /// Reads numbers from stdin, picking that many strings for each one.
+    Watch {
+        #[arg(value_hint = ValueHint::FilePath)]
+        file: PathBuf,
+    },
+    /// Add strings from stdin as they arrive, picking NUM of them each time SIGUSR1 is received.
+    /// Strings already in the database keep their history. Exits when stdin is closed.
+    Stream { num: usize },
+    /// Pick NUM files from the directory tree at PATH, using their paths relative to PATH as the
+    /// strings stored in the database.
+    Dir {
+        #[arg(value_hint = ValueHint::DirPath)]
+        path: PathBuf,
+        num: usize,
+        #[arg(long)]
+        /// Only consider files with relative paths matching this glob. Can be repeated.
+        include: Vec<String>,
+        #[arg(long)]
+        /// Ignore files with relative paths matching this glob. Can be repeated.
+        exclude: Vec<String>,
+        #[command(flatten)]
+        filters: Filters,
+    },
+    /// Keep the database open and synchronized with the files in the directory tree at PATH,
+    /// rescanning it every INTERVAL or on SIGHUP. New files are added and deleted files are soft
+    /// removed, keeping their history in the database.
+    ///
+    /// Reads numbers from stdin, picking that many files for each one.
+    WatchDir {
+        #[arg(value_hint = ValueHint::DirPath)]
+        path: PathBuf,
+        #[arg(long, value_parser = humantime::parse_duration, default_value = "10s")]
+        /// How long to wait between scans, such as "30s" or "5m".
+        interval: Duration,
+        #[arg(long)]
+        /// Only consider files with relative paths matching this glob. Can be repeated.
+        include: Vec<String>,
+        #[arg(long)]
+        /// Ignore files with relative paths matching this glob. Can be repeated.
+        exclude: Vec<String>,
+    },
+    /// Export the contents of the database to FILE, or stdout, as lines of
+    /// "GENERATION<TAB>STRING". The output can be edited and restored with import.
+    Export {
+        #[arg(value_hint = ValueHint::FilePath)]
+        file: Option<PathBuf>,
+    },
+    /// Import lines of "GENERATION<TAB>STRING" from FILE, or stdin, into the database.
+    /// Generations are overwritten for strings that are already present.
+    Import {
+        #[arg(value_hint = ValueHint::FilePath)]
+        file: Option<PathBuf>,
+        #[arg(long)]
+        /// Remove everything not present in the input from the database.
+        replace: bool,
+    },
+    /// Reset STRINGS so they're treated as if they were never picked, making them as likely to be
+    /// picked as the least recently picked strings. Resets everything if no strings are given.
+    Reset {
+        strings: Vec<String>,
+        #[arg(long, conflicts_with = "strings")]
+        /// Read the strings to reset from stdin.
+        stdin: bool,
+        #[arg(long, conflicts_with_all = ["strings", "stdin"])]
+        /// Reset all strings matching this regular expression.
+        pattern: Option<Regex>,
+    },
+    /// Rename OLD to NEW, keeping its history. NEW is overwritten if it is already present.
+    Rename {
+        #[arg(required_unless_present = "from_file")]
+        old: Option<String>,
+        #[arg(required_unless_present = "from_file")]
+        new: Option<String>,
+        #[arg(long, conflicts_with_all = ["old", "new"], value_hint = ValueHint::FilePath)]
+        /// Read lines of "OLD<TAB>NEW" from this file instead. Missing strings are skipped.
+        from_file: Option<PathBuf>,
+    },
+    /// Remove all strings matching PATTERN from the database, printing each one removed.
+    Prune {
+        pattern: Regex,
+        #[arg(long)]
+        /// Print the strings that would be removed without removing them.
+        dry_run: bool,
+    },
+    /// Read strings from stdin and mark them as if they had just been picked together.
+    /// Strings not already in the database are added.
+    Touch,
+    /// Save the current state of the database as NAME so it can be restored with rollback, such
+    /// as before an import or prune. Lists the existing snapshots if NAME is omitted.
+    Snapshot { name: Option<String> },
+    /// Restore the database to the snapshot NAME. The snapshot is kept.
+    Rollback { name: String },
+    /// Apply the operations recorded with --log to the database, in order. Replaying a complete
+    /// log into a new database rebuilds the original, except for resets and imports which aren't
+    /// logged.
+    Replay {
+        #[arg(value_hint = ValueHint::FilePath)]
+        file: PathBuf,
+    },
+    /// Serve the database over HTTP so it can be shared between programs and machines.
+    ///
+    /// POST /pick?n=NUM picks NUM strings, defaulting to 1. POST /add adds newline separated
+    /// strings from the request body. GET /values lists every string and GET /stats reports the
+    /// number of strings and the range of generations. GET /health fails with 503 if the database
+    /// can no longer be written to. All responses are JSON.
+    ///
+    /// With multiple --db each database is served under /NAME, such as /NAME/pick, where NAME is
+    /// the last component of its path. The first database is also served without a prefix and is
+    /// the only one synchronized with --file or --dir. GET /pickers reports the stats of every
+    /// database by name. --log is ignored when serving multiple databases.
+    ///
+    /// SIGHUP reloads the config file and re-reads --file or --dir between requests.
+    Serve {
+        #[arg(long, default_value = "127.0.0.1:8080")]
+        /// The address to listen on. ":PORT" listens on every interface.
+        http: String,
+        #[arg(long)]
+        /// Require requests to send "Authorization: Bearer TOKEN".
+        token: Option<String>,
+        #[arg(long, requires = "token")]
+        /// Also accept this token, but only for GET requests that don't change any database.
+        read_token: Option<String>,
+        #[arg(long, conflicts_with = "dir", value_hint = ValueHint::FilePath)]
+        /// Keep the database synchronized with the strings in this file, like watch.
+        file: Option<PathBuf>,
+        #[arg(long, value_hint = ValueHint::DirPath)]
+        /// Keep the database synchronized with the files in this directory tree, like watch-dir.
+        dir: Option<PathBuf>,
+    },
+    /// Measure how quickly NUM strings can be added, picked, and loaded using a temporary
+    /// database, to compare hardware and storage. Does not require --db.
+    Bench {
+        #[arg(default_value_t = 100_000)]
+        num: usize,
+    },
+    /// Print a completion script for SHELL to stdout. Does not require --db.
+    Completions { shell: Shell },
+}
+
+#[derive(Clone, Copy, Default, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum Format {
+    /// Aligned columns for reading in a terminal.
+    #[default]
+    Table,
+    /// Tab separated values. Strings containing tabs or newlines will not be escaped.
+    Tsv,
+    /// Comma separated values.
+    Csv,
+    /// The same as --json.
+    Json,
+}
+
+impl Format {
+    const fn or_json(self, json: bool) -> Self {
+        if json { Self::Json } else { self }
+    }
+}
+
+#[derive(clap::Args)]
+struct DumpArgs {
+    #[arg(long, value_enum)]
+    /// Defaults to table.
+    format: Option<Format>,
+    #[arg(long, value_enum, default_value_t)]
+    sort: Sort,
+    #[arg(long)]
+    /// Start with the number of strings and the range of generations. These are "# NAME: VALUE"
+    /// lines, or fields alongside "items" with JSON.
+    header: bool,
+}
+
+#[derive(Clone, Copy, Default, ValueEnum)]
+enum Sort {
+    /// Sort by string.
+    #[default]
+    Key,
+    /// Sort by generation, least recently picked first.
+    Generation,
+}
+
+/// The command line options merged with the config file.
+struct Settings {
+    // Empty and unused when no_db is set.
+    db: PathBuf,
+    // Only used by pick and serve.
+    extra_dbs: Vec<PathBuf>,
+    no_db: bool,
+    bias: f64,
+    seed: Option<u64>,
+    keep_missing: bool,
+    distribute_new: bool,
+    null: bool,
+    json: bool,
+    format: Option<Format>,
+    template: Option<Template>,
+    wait_lock: Option<Duration>,
+    log: Option<PathBuf>,
+    root: Option<PathBuf>,
+}
+
+impl Settings {
+    fn new(opt: &Opt, config: Config) -> Self {
+        let db = if opt.no_db {
+            if !matches!(opt.cmd, Command::Pick { .. } | Command::Dir { .. }) {
+                Opt::command()
+                    .error(ErrorKind::ArgumentConflict, "--no-db only works with pick and dir")
+                    .exit()
+            }
+            vec![PathBuf::new()]
+        } else if !opt.db.is_empty() {
+            opt.db.clone()
+        } else if let Some(name) = &opt.name {
+            named_db(name).into_iter().collect()
+        } else if let Some(db) = config.db {
+            vec![db]
+        } else {
+            named_db("default").into_iter().collect()
+        };
+
+        let mut dbs = db.into_iter();
+        let Some(db) = dbs.next() else {
+            Opt::command()
+                .error(
+                    ErrorKind::MissingRequiredArgument,
+                    "--db must be set when neither $XDG_DATA_HOME nor $HOME is set",
+                )
+                .exit()
+        };
+
+        let extra_dbs: Vec<_> = dbs.collect();
+        let multi = matches!(opt.cmd, Command::Pick { .. } | Command::Serve { .. });
+        if !extra_dbs.is_empty() && !multi {
+            let msg = "only pick and serve can use multiple databases";
+            Opt::command().error(ErrorKind::ArgumentConflict, msg).exit()
+        }
+
+        let bias = opt.bias.or(config.bias).unwrap_or(2.0);
+        if bias.is_nan() || bias.is_sign_negative() {
+            Opt::command().error(ErrorKind::ValueValidation, format!("Invalid bias {bias}")).exit()
+        }
+
+        Self {
+            db,
+            extra_dbs,
+            no_db: opt.no_db,
+            bias,
+            seed: opt.seed,
+            keep_missing: opt.keep_missing || config.keep_missing,
+            distribute_new: opt.distribute_new || config.distribute_new,
+            null: opt.null || config.null,
+            json: opt.json || config.json,
+            format: config.format,
+            template: opt.template.clone(),
+            wait_lock: opt.wait_lock,
+            log: opt.log.clone().or(config.log),
+            root: opt.root.clone().or(config.root),
+        }
+    }
+
+    fn read_stdin(&self) -> Vec<String> {
+        self.relative_all(read_stdin(self.null))
+    }
+
+    fn relative_all(&self, strings: Vec<String>) -> Vec<String> {
+        strings.into_iter().map(|s| self.relative(s)).collect()
+    }
+
+    // Strings that aren't paths under the root are stored unchanged.
+    fn relative(&self, s: String) -> String {
+        let Some(root) = &self.root else {
+            return s;
+        };
+
+        match Path::new(&s).strip_prefix(root) {
+            Ok(rel) if !rel.as_os_str().is_empty() => rel.to_string_lossy().into_owned(),
+            _ => s,
+        }
+    }
+
+    // Joining leaves strings that were already absolute paths unchanged.
+    fn absolute(&self, s: String) -> String {
+        match &self.root {
+            Some(root) => root.join(s).to_string_lossy().into_owned(),
+            None => s,
+        }
+    }
+
+    // Picks from multiple databases can't be attributed to one, so they aren't logged.
+    fn record(&self, op: Op, keys: &[String]) {
+        if let Some(log) = &self.log {
+            if !self.no_db && self.extra_dbs.is_empty() {
+                oplog::append(log, op, keys.to_vec());
+            }
+        }
+    }
+
+    fn format(&self, format: Option<Format>) -> Format {
+        format.or(self.format).unwrap_or_default().or_json(self.json)
+    }
+
+    // Finding the generation of picked strings requires a full scan, so avoid it when unused.
+    fn picked_generation<S: AwShuffler>(&self, s: &S) -> Option<u64> {
+        if !self.template.as_ref().is_some_and(Template::uses_generation) {
+            return None;
+        }
+
+        s.dump().into_iter().map(|(_, g)| g).max()
+    }
+
+    const fn new_item_handling(&self) -> NewItemHandling {
+        if self.distribute_new { NewItemHandling::Random } else { NewItemHandling::NeverSelected }
+    }
+
+    // Retries while another process holds the lock, for up to --wait-lock.
+    fn open<T, E: Classify>(&self, db: &Path, mut open: impl FnMut() -> Result<T, E>) -> T {
+        let deadline = self.wait_lock.map(|w| Instant::now() + w);
+
+        loop {
+            match open() {
+                Ok(v) => return v,
+                Err(e)
+                    if matches!(e.exit(), Exit::Locked)
+                        && deadline.is_some_and(|d| Instant::now() < d) =>
+                {
+                    thread::sleep(LOCK_RETRY_INTERVAL);
+                }
+                Err(e) => {
+                    fail(e.exit(), format_args!("Failed to open the database at {db:?}: {e}"))
+                }
+            }
+        }
+    }
+
+    fn open_db(&self) -> DB {
+        self.open(&self.db, || open_all(&db_options(), &self.db))
+    }
+
+    fn open_shuffler(&self, strings: Option<Vec<String>>, keep_all: bool) -> Shuffler<String> {
+        self.open_shuffler_at(&self.db, strings, keep_all)
+    }
+
+    fn open_shuffler_at(
+        &self,
+        db: &Path,
+        strings: Option<Vec<String>>,
+        keep_all: bool,
+    ) -> Shuffler<String> {
+        // The strings are consumed on each attempt so they're only copied when it might retry.
+        let mut strings = Some(strings);
+
+        let mut s = self.open(db, || {
+            let strings =
+                if self.wait_lock.is_some() { strings.clone() } else { strings.take() }.flatten();
+            let options = self.shuffler_options();
+            let options = if keep_all { options.keep_unrecognized(true) } else { options };
+            Shuffler::new(db, options, strings)
+        });
+
+        let removed = s.take_unrecognized();
+        if !removed.is_empty() {
+            self.record(Op::Remove, &removed);
+        }
+        s
+    }
+
+    fn shuffler_options(&self) -> ShufflerOptions<String> {
+        let options = ShufflerOptions::default()
+            .bias(self.bias)
+            .new_item_handling(self.new_item_handling())
+            .keep_unrecognized(self.keep_missing);
+        match self.seed {
+            Some(seed) => options.seed(seed),
+            None => options,
+        }
+    }
+}
+
+// RocksDB only creates the final directory, so the data directory is created here.
+fn named_db(name: &str) -> Option<PathBuf> {
+    if name.is_empty() || name == "." || name == ".." || name.contains(['/', '\\']) {
+        Opt::command()
+            .error(ErrorKind::ValueValidation, format!("Invalid database name {name:?}"))
+            .exit()
+    }
+
+    let db = Config::named_db(name)?;
+    if let Some(parent) = db.parent() {
+        fs::create_dir_all(parent).or_exit(format_args!("Failed to create {parent:?}"));
+    }
+    Some(db)
+}
+
+#[derive(clap::Args)]
+struct Filters {
+    #[arg(long)]
+    /// Only pick strings matching this regular expression. Strings that don't match are still
+    /// kept in the database.
+    filter: Option<Regex>,
+    #[arg(long)]
+    /// Never pick strings matching this regular expression. Strings that match are still kept in
+    /// the database.
+    exclude_pattern: Option<Regex>,
+    #[arg(long, value_hint = ValueHint::FilePath)]
+    /// Never pick any of the strings listed, one per line, in this file. They are still kept in
+    /// the database.
+    exclude_file: Option<PathBuf>,
+    #[arg(long)]
+    /// Treat strings as file paths and never pick ones that don't exist. Missing files are soft
+    /// removed and replaced with new picks, so they keep their history if they come back.
+    check_exists: bool,
+}
+
+impl Filters {
+    fn allows(&self, s: &str, blocked: &HashSet<String>) -> bool {
+        if self.filter.as_ref().is_some_and(|f| !f.is_match(s)) {
+            return false;
+        }
+
+        !self.exclude_pattern.as_ref().is_some_and(|e| e.is_match(s)) && !blocked.contains(s)
+    }
+
+    fn blocked(&self) -> HashSet<String> {
+        match &self.exclude_file {
+            Some(file) => read_lines(file, false)
+                .or_exit(format_args!("Failed to read {file:?}"))
+                .into_iter()
+                .collect(),
+            None => HashSet::new(),
+        }
+    }
+
+    // Soft removes everything that isn't allowed so it can't be picked but stays in the database.
+    fn apply(&self, s: &mut Shuffler<String>) {
+        if self.filter.is_none() && self.exclude_pattern.is_none() && self.exclude_file.is_none() {
+            return;
+        }
+
+        let blocked = self.blocked();
+        let excluded: Vec<_> =
+            s.values().into_iter().filter(|v| !self.allows(v, &blocked)).cloned().collect();
+
+        for v in &excluded {
+            s.soft_remove(v).or_exit("Failed to write to the database");
+        }
+    }
+
+    // Relative paths are resolved against root when it's set, otherwise the working directory.
+    fn missing(&self, picked: &[String], root: Option<&Path>) -> Vec<String> {
+        if !self.check_exists {
+            return Vec::new();
+        }
+
+        picked
+            .iter()
+            .filter(|p| !root.map_or_else(|| Path::new(p).exists(), |r| r.join(p).exists()))
+            .cloned()
+            .collect()
+    }
+}
+
+enum Event {
+    Add(String),
+    Pick(usize),
+    Reload,
+    Request(tiny_http::Request),
+    Exit,
 }
 
 fn main() {
     let opt = Opt::parse();
+    error::set_quiet(opt.quiet);
 
+    if let Command::Completions { shell } = opt.cmd {
+        clap_complete::generate(shell, &mut Opt::command(), "strpick", &mut io::stdout());
+        return;
+    }
+
+    if let Command::Bench { num } = opt.cmd {
+        bench::bench(num);
+        return;
+    }
+
+    let settings = Settings::new(&opt, Config::load(opt.config.as_deref()));
+    let db = &settings.db;
+
+    if let Some(remote) = &opt.remote {
+        let Command::Pick { num, consume: false, filters } = &opt.cmd else {
+            Opt::command()
+                .error(ErrorKind::ArgumentConflict, "--remote only supports pick without --consume")
+                .exit()
+        };
+        if filters.filter.is_some()
+            || filters.exclude_pattern.is_some()
+            || filters.exclude_file.is_some()
+            || filters.check_exists
+        {
+            Opt::command()
+                .error(ErrorKind::ArgumentConflict, "--remote does not support filters")
+                .exit()
+        }
+
+        let client = remote::Client::new(remote, opt.remote_token.clone());
+        let strings = settings.read_stdin();
+        if !strings.is_empty() {
+            client.add(&strings).or_exit(format_args!("Failed to add strings to {remote}"));
+        }
+        let picked = client.pick(*num).or_exit(format_args!("Failed to pick from {remote}"));
+        print_picked(&settings, &picked, None);
+        return;
+    }
 
     match &opt.cmd {
-        Command::Pick { num } => pick(&opt.db, *num),
-        Command::Dump => dump(&opt.db, |v| {
-            if let rmpv::Value::String(s) = v {
-                s.as_str().unwrap().to_owned()
-            } else {
-                panic!("Item {v} is not string")
+        Command::Pick { num, consume, filters } => {
+            let root = settings.root.as_deref();
+            let (picked, gen) =
+                pick(&settings, settings.read_stdin(), *num, filters, root, *consume);
+            let paths: Vec<_> = picked.iter().map(|p| settings.absolute(p.clone())).collect();
+            print_picked(&settings, &paths, gen);
+            settings.record(Op::Pick, &picked);
+
+            if *consume && !settings.no_db {
+                settings.record(Op::Remove, &picked);
+            }
+        }
+        Command::Loop { interval, cmd, filters } => {
+            pick_loop(&settings, settings.read_stdin(), *interval, cmd, filters)
+        }
+        Command::Dump(args) => dump(&settings, args, string_item),
+        Command::DumpRaw(args) => dump(&settings, args, |v| v.to_string()),
+        Command::Repair => repair(db),
+        Command::Compact => compact(&settings),
+        Command::Verify => verify(&settings),
+        Command::Watch { file } => watch(&settings, file),
+        Command::Stream { num } => stream(&settings, *num),
+        Command::Dir { path, num, include, exclude, filters } => {
+            let (picked, gen) = dir(&settings, path, *num, include, exclude, filters);
+            let paths: Vec<_> =
+                picked.iter().map(|p| path.join(p).to_string_lossy().into_owned()).collect();
+            print_picked(&settings, &paths, gen);
+            settings.record(Op::Pick, &picked);
+        }
+        Command::WatchDir { path, interval, include, exclude } => {
+            watch_dir(&settings, path, *interval, include, exclude)
+        }
+        Command::Export { file } => export(db, file.as_deref()),
+        Command::Import { file, replace } => import(&settings.open_db(), file.as_deref(), *replace),
+        Command::Reset { strings, stdin, pattern } => {
+            // Only an empty command line resets everything, not an empty stdin.
+            let strings = match (*stdin, strings.is_empty()) {
+                (true, _) => Some(settings.read_stdin()),
+                (false, true) => None,
+                (false, false) => Some(strings.clone()),
+            };
+            reset(&settings.open_db(), strings, pattern.as_ref())
+        }
+        Command::Touch => {
+            let strings = settings.read_stdin();
+            touch(&settings.open_db(), strings.clone());
+            settings.record(Op::Pick, &strings);
+        }
+        Command::Rename { old, new, from_file } => {
+            let renamed = match (old, new, from_file) {
+                (Some(old), Some(new), None) => {
+                    rename(&settings.open_db(), vec![(old.clone(), new.clone())], true)
+                }
+                (None, None, Some(file)) => rename(&settings.open_db(), read_renames(file), false),
+                _ => unreachable!(),
+            };
+            let pairs: Vec<_> = renamed.into_iter().flat_map(|(old, new)| [old, new]).collect();
+            settings.record(Op::Rename, &pairs);
+        }
+        Command::Prune { pattern, dry_run } => {
+            let pruned = prune(&settings.open_db(), pattern, *dry_run);
+            if !dry_run {
+                settings.record(Op::Remove, &pruned);
             }
-        }),
-        Command::DumpRaw => dump(&opt.db, |v| v.to_string()),
-        Command::Repair => repair(&opt.db),
+            print_strings(&pruned, settings.json)
+        }
+        Command::Snapshot { name: Some(name) } => snapshot::snapshot(&settings.open_db(), db, name),
+        Command::Snapshot { name: None } => print_strings(&snapshot::list(db), settings.json),
+        Command::Rollback { name } => snapshot::rollback(&settings.open_db(), db, name),
+        Command::Replay { file } => oplog::replay(&settings.open_db(), file),
+        Command::Serve { http, token, read_token, file, dir } => {
+            let source = match (file, dir) {
+                (Some(file), _) => Some(Source::File(file)),
+                (_, Some(dir)) => Some(Source::Dir(dir)),
+                (None, None) => None,
+            };
+            let reload = || Config::try_load(opt.config.as_deref()).map(|c| Settings::new(&opt, c));
+            let tokens = serve::Tokens { full: token.as_deref(), read: read_token.as_deref() };
+            serve::serve(settings, http, tokens, source, reload)
+        }
+        Command::Completions { .. } | Command::Bench { .. } => unreachable!(),
     }
 }
 
-fn dump<F: Fn(rmpv::Value) -> String>(db: &Path, f: F) {
-    let tdir = tempdir().unwrap();
+fn dump<F: Fn(rmpv::Value) -> String>(settings: &Settings, args: &DumpArgs, f: F) {
+    let mut vals = read_db(&settings.db, f);
+
+    match args.sort {
+        Sort::Key => vals.sort_unstable_by(|(a, _), (b, _)| a.cmp(b)),
+        Sort::Generation => vals.sort_unstable_by(|(a, ag), (b, bg)| ag.cmp(bg).then(a.cmp(b))),
+    }
+
+    let format = settings.format(args.format);
+
+    if args.header {
+        let count = vals.len();
+        let min_gen = vals.iter().map(|(_, g)| *g).min();
+        let max_gen = vals.iter().map(|(_, g)| *g).max();
+
+        // The header is part of the same object so the output is still a single JSON value.
+        if settings.template.is_none() && matches!(format, Format::Json) {
+            let header = json!({
+                "count": count,
+                "min_generation": min_gen,
+                "max_generation": max_gen,
+                "items": json_items(&vals),
+            });
+            println!("{header}");
+            return;
+        }
+
+        println!("# count: {count}");
+        if let (Some(min_gen), Some(max_gen)) = (min_gen, max_gen) {
+            println!("# min_generation: {min_gen}");
+            println!("# max_generation: {max_gen}");
+        }
+    }
+
+    match &settings.template {
+        Some(t) => {
+            for (s, g) in vals {
+                println!("{}", t.render(&s, Some(g)));
+            }
+        }
+        None => print(vals, format),
+    }
+}
+
+// Reads the contents of the database without taking the lock or modifying it.
+fn read_db<F: Fn(rmpv::Value) -> String>(db: &Path, f: F) -> Vec<(String, u64)> {
+    let tdir = tempdir().or_exit("Failed to create a temporary directory");
     let mut options = Options::default();
     options.set_compression_type(rocksdb::DBCompressionType::Lz4);
 
-    let db = DB::open_as_secondary(&options, db, tdir.path()).unwrap();
+    let db = DB::open_as_secondary(&options, db, tdir.path())
+        .or_exit(format_args!("Failed to open the database at {db:?}"));
 
+    let contents = decode_db(&db, f);
+
+    drop(db);
+    drop(tdir);
+    contents
+}
+
+fn decode_db<F: Fn(rmpv::Value) -> String>(db: &DB, f: F) -> Vec<(String, u64)> {
     let mut contents = Vec::new();
 
     for (key, value) in db.iterator(rocksdb::IteratorMode::Start).flatten() {
-        let k = rmpv::decode::value::read_value(&mut key.as_ref()).unwrap();
-        let gen = rmpv::decode::value::read_value(&mut value.as_ref()).unwrap();
+        let k = rmpv::decode::value::read_value(&mut key.as_ref()).or_exit("Invalid key");
+        let gen = rmpv::decode::value::read_value(&mut value.as_ref()).or_exit("Invalid value");
 
-        let gen = if let rmpv::Value::Integer(g) = gen {
-            g.as_u64().unwrap()
-        } else {
-            panic!("Generation not integer")
+        let Some(gen) = gen.as_u64() else {
+            fail(Exit::Corrupt, format_args!("Generation {gen} for {k} is not an integer"))
         };
 
         contents.push((f(k), gen));
     }
 
-    print(contents);
+    contents
+}
 
-    drop(db);
-    drop(tdir);
+fn string_item(v: rmpv::Value) -> String {
+    match v.as_str() {
+        Some(s) => s.to_owned(),
+        None => fail(Exit::Corrupt, format_args!("Item {v} is not a string")),
+    }
+}
+
+fn encode(v: rmpv::Value) -> Vec<u8> {
+    let mut buf = Vec::new();
+    rmpv::encode::write_value(&mut buf, &v).unwrap();
+    buf
 }
 
-fn print(mut vals: Vec<(String, u64)>) {
+fn export(db: &Path, file: Option<&Path>) {
+    let mut vals = read_db(db, string_item);
     vals.sort_unstable_by(|(a, _), (b, _)| a.cmp(b));
 
+    let mut out: Box<dyn Write> = match file {
+        Some(file) => Box::new(BufWriter::new(
+            File::create(file).or_exit(format_args!("Failed to create {file:?}")),
+        )),
+        None => Box::new(io::stdout().lock()),
+    };
+
+    for (s, g) in vals {
+        writeln!(out, "{g}\t{s}").or_exit("Failed to write the export");
+    }
+    out.flush().or_exit("Failed to write the export");
+}
+
+fn import(db: &DB, file: Option<&Path>, replace: bool) {
+    let lines = match file {
+        Some(file) => read_lines(file, false).or_exit(format_args!("Failed to read {file:?}")),
+        None => read_stdin(false),
+    };
+
+    let mut batch = WriteBatch::default();
+
+    if replace {
+        for (key, _) in db.iterator(rocksdb::IteratorMode::Start).flatten() {
+            delete_key(db, &mut batch, &key);
+        }
+    }
+
+    for (i, line) in lines.into_iter().enumerate() {
+        let Some((gen, s)) = line.split_once('\t') else {
+            let msg =
+                format!("Line {} is not in the format GENERATION<TAB>STRING: {line:?}", i + 1);
+            fail(Exit::Failure, msg)
+        };
+        let gen: u64 =
+            gen.parse().or_exit(format_args!("Invalid generation {gen:?} on line {}", i + 1));
+
+        put_key(db, &mut batch, &encode(s.into()), &encode(gen.into()));
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+}
+
+fn print(vals: Vec<(String, u64)>, format: Format) {
+    match format {
+        Format::Table => print_table(vals),
+        Format::Tsv => {
+            for (s, g) in vals {
+                println!("{s}\t{g}");
+            }
+        }
+        Format::Csv => {
+            for (s, g) in vals {
+                println!("{},{g}", csv_escape(&s));
+            }
+        }
+        Format::Json => println!("{}", json!(json_items(&vals))),
+    }
+}
+
+fn json_items(vals: &[(String, u64)]) -> Vec<serde_json::Value> {
+    vals.iter().map(|(s, g)| json!({"item": s, "generation": g})).collect()
+}
+
+fn print_table(vals: Vec<(String, u64)>) {
     let (kw, vw) = vals.iter().fold((0, 0), |(kw, vw), (s, g)| {
         let gw = if *g == 0 { 1 } else { (*g as f64).log10() as usize + 1 };
         (max(kw, UnicodeWidthStr::width(s.as_str())), max(vw, gw))
@@ -96,25 +943,828 @@ fn print(mut vals: Vec<(String, u64)>) {
     }
 }
 
-fn pick(db: &Path, num: usize) {
+fn csv_escape(s: &str) -> Cow<'_, str> {
+    if s.contains([',', '"', '\n', '\r']) {
+        format!("\"{}\"", s.replace('"', "\"\"")).into()
+    } else {
+        s.into()
+    }
+}
+
+fn read_stdin(null: bool) -> Vec<String> {
     let stdin = io::stdin();
-    let strings: Vec<_> = stdin.lock().lines().flatten().collect();
+    read_strings(stdin.lock(), null)
+}
+
+fn read_strings<R: BufRead>(r: R, null: bool) -> Vec<String> {
+    read_strings_iter(r, null).collect()
+}
+
+fn read_strings_iter<'a, R: BufRead + 'a>(
+    r: R,
+    null: bool,
+) -> Box<dyn Iterator<Item = String> + 'a> {
+    if null {
+        Box::new(r.split(b'\0').map_while(Result::ok).filter_map(|s| String::from_utf8(s).ok()))
+    } else {
+        Box::new(r.lines().flatten())
+    }
+}
+
+// Returns the picked strings and, if the template needs it, the generation they now have.
+fn pick(
+    settings: &Settings,
+    strings: Vec<String>,
+    num: usize,
+    filters: &Filters,
+    root: Option<&Path>,
+    consume: bool,
+) -> (Vec<String>, Option<u64>) {
+    if settings.no_db {
+        return pick_in_memory(settings, strings, num, filters, root);
+    }
+
+    if !settings.extra_dbs.is_empty() {
+        return pick_multi(settings, strings, num, filters, root, consume);
+    }
 
     let strings = if !strings.is_empty() { Some(strings) } else { None };
 
-    let mut s: Shuffler<String> = Shuffler::new_default(db, strings)
-        .unwrap_or_else(|e| panic!("Failed to open the database at {db:?}: {e}"));
+    let mut s = settings.open_shuffler(strings, false);
+
+    filters.apply(&mut s);
+
+    // Every retry removes at least one string, so this always terminates.
+    let picked = loop {
+        let picked: Vec<_> = s
+            .try_unique_n(num)
+            .or_exit("Failed to write to the database")
+            .into_iter()
+            .flatten()
+            .cloned()
+            .collect();
 
-    for s in s.try_unique_n(num).unwrap().into_iter().flatten() {
+        let missing = filters.missing(&picked, root);
+        if missing.is_empty() {
+            break picked;
+        }
+
+        for m in &missing {
+            s.soft_remove(m).or_exit("Failed to write to the database");
+        }
+    };
+    let gen = settings.picked_generation(&s);
+
+    if consume {
+        for p in &picked {
+            s.remove(p).or_exit("Failed to write to the database");
+        }
+    }
+
+    s.close_leak().or_exit("Failed to close the database");
+    (picked, gen)
+}
+
+// Splits the picks between the databases in proportion to their sizes, then merges the results.
+// Generations aren't comparable between databases so none is returned.
+fn pick_multi(
+    settings: &Settings,
+    strings: Vec<String>,
+    num: usize,
+    filters: &Filters,
+    root: Option<&Path>,
+    consume: bool,
+) -> (Vec<String>, Option<u64>) {
+    if !strings.is_empty() {
+        fail(Exit::Usage, "Strings can't be read from stdin when picking from multiple databases");
+    }
+
+    let shufflers: Vec<_> = iter::once(&settings.db)
+        .chain(&settings.extra_dbs)
+        .map(|db| {
+            let mut s = settings.open_shuffler_at(db, None, false);
+            filters.apply(&mut s);
+            let weight = s.size() as f64;
+            (s, weight)
+        })
+        .collect();
+
+    let mut multi = match settings.seed {
+        Some(seed) => MultiShuffler::new_seeded(shufflers, seed),
+        None => MultiShuffler::new(shufflers),
+    };
+
+    let picked = loop {
+        let picked = match multi.unique_n(num).or_exit("Failed to write to the database") {
+            Some(p) => Some(p),
+            None => multi.next_n(num).or_exit("Failed to write to the database"),
+        };
+        let (dbs, picked): (Vec<_>, Vec<_>) =
+            picked.into_iter().flatten().map(|(i, s)| (i, s.clone())).unzip();
+
+        let missing = filters.missing(&picked, root);
+        if missing.is_empty() {
+            break (dbs, picked);
+        }
+
+        for (i, p) in dbs.into_iter().zip(&picked).filter(|(_, p)| missing.contains(p)) {
+            // The index always came from this MultiShuffler.
+            multi.get_mut(i).unwrap().soft_remove(p).or_exit("Failed to write to the database");
+        }
+    };
+    let (dbs, picked) = picked;
+
+    // The same string can be in more than one database, so it's only removed from the one it was
+    // picked from.
+    if consume {
+        for (i, p) in dbs.into_iter().zip(&picked) {
+            multi.get_mut(i).unwrap().remove(p).or_exit("Failed to write to the database");
+        }
+    }
+
+    for (s, _) in multi.into_inner() {
+        s.close_leak().or_exit("Failed to close the database");
+    }
+    (picked, None)
+}
+
+fn pick_in_memory(
+    settings: &Settings,
+    strings: Vec<String>,
+    num: usize,
+    filters: &Filters,
+    root: Option<&Path>,
+) -> (Vec<String>, Option<u64>) {
+    let mut s = match settings.seed {
+        Some(seed) => {
+            aw_shuffle::Shuffler::new_seeded(settings.bias, settings.new_item_handling(), seed)
+        }
+        None => aw_shuffle::Shuffler::new(settings.bias, settings.new_item_handling()),
+    };
+
+    let blocked = filters.blocked();
+    for v in strings.into_iter().filter(|v| filters.allows(v, &blocked)) {
+        s.inf_add(v);
+    }
+
+    let picked = loop {
+        let picked: Vec<_> = s.inf_try_unique_n(num).into_iter().flatten().cloned().collect();
+
+        let missing = filters.missing(&picked, root);
+        if missing.is_empty() {
+            break picked;
+        }
+
+        for m in &missing {
+            s.inf_remove(m);
+        }
+    };
+    (picked, settings.picked_generation(&s))
+}
+
+fn pick_loop(
+    settings: &Settings,
+    strings: Vec<String>,
+    interval: Duration,
+    cmd: &[String],
+    filters: &Filters,
+) {
+    let strings = if !strings.is_empty() { Some(strings) } else { None };
+
+    let mut s = settings.open_shuffler(strings, false);
+
+    filters.apply(&mut s);
+
+    loop {
+        let picked = loop {
+            let picked = s.next().or_exit("Failed to write to the database").cloned();
+            let Some(p) = filters.missing(picked.as_slice(), settings.root.as_deref()).pop() else {
+                break picked;
+            };
+            s.soft_remove(&p).or_exit("Failed to write to the database");
+        };
+
+        match picked {
+            Some(picked) => {
+                settings.record(Op::Pick, slice::from_ref(&picked));
+                run_or_print(
+                    settings,
+                    settings.absolute(picked),
+                    settings.picked_generation(&s),
+                    cmd,
+                )
+            }
+            None => eprintln!("Nothing to pick"),
+        }
+
+        thread::sleep(interval);
+    }
+}
+
+fn run_or_print(settings: &Settings, picked: String, gen: Option<u64>, cmd: &[String]) {
+    let Some((program, args)) = cmd.split_first() else {
+        print_picked(settings, &[picked], gen);
+        return;
+    };
+
+    match process::Command::new(program).args(args).arg(&picked).status() {
+        Ok(status) if !status.success() => eprintln!("{program} exited with {status}"),
+        Ok(_) => {}
+        Err(e) => eprintln!("Failed to run {program}: {e}"),
+    }
+}
+
+fn print_strings(strings: &[String], json: bool) {
+    if json {
+        println!("{}", json!(strings));
+        return;
+    }
+
+    for s in strings {
         println!("{s}")
     }
+}
+
+fn print_picked(settings: &Settings, strings: &[String], gen: Option<u64>) {
+    let Some(template) = &settings.template else {
+        print_strings(strings, settings.json);
+        return;
+    };
+
+    for s in strings {
+        println!("{}", template.render(s, gen));
+    }
+}
+
+// Strings are printed as paths under root when it's set, falling back to --root.
+fn print_picks(settings: &Settings, s: &mut Shuffler<String>, num: usize, root: Option<&Path>) {
+    let picked: Vec<_> = s
+        .try_unique_n(num)
+        .or_exit("Failed to write to the database")
+        .into_iter()
+        .flatten()
+        .cloned()
+        .collect();
+    settings.record(Op::Pick, &picked);
+
+    let gen = settings.picked_generation(s);
+    match root.or(settings.root.as_deref()) {
+        Some(root) => {
+            let paths: Vec<_> =
+                picked.iter().map(|p| root.join(p).to_string_lossy().into_owned()).collect();
+            print_picked(settings, &paths, gen);
+        }
+        None => print_picked(settings, &picked, gen),
+    }
+}
+
+fn globs(patterns: &[String]) -> GlobSet {
+    let mut builder = GlobSetBuilder::new();
+    for p in patterns {
+        builder.add(Glob::new(p).or_exit(format_args!("Invalid glob {p:?}")));
+    }
+    builder.build().or_exit("Invalid globs")
+}
+
+fn dir(
+    settings: &Settings,
+    root: &Path,
+    num: usize,
+    include: &[String],
+    exclude: &[String],
+    filters: &Filters,
+) -> (Vec<String>, Option<u64>) {
+    let include = if include.is_empty() { None } else { Some(globs(include)) };
+    let exclude = globs(exclude);
+
+    let mut files = Vec::new();
+    walk(root, root, include.as_ref(), &exclude, &mut files)
+        .or_exit(format_args!("Failed to read directory {root:?}"));
+
+    pick(settings, files, num, filters, Some(root), false)
+}
+
+// Symlinks to files are followed but symlinks to directories are not, to avoid loops.
+fn walk(
+    root: &Path,
+    dir: &Path,
+    include: Option<&GlobSet>,
+    exclude: &GlobSet,
+    files: &mut Vec<String>,
+) -> io::Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let path = entry.path();
+        let file_type = entry.file_type()?;
+
+        if file_type.is_dir() {
+            walk(root, &path, include, exclude, files)?;
+            continue;
+        }
+
+        let is_file = file_type.is_file() || (file_type.is_symlink() && path.is_file());
+        if !is_file {
+            continue;
+        }
+
+        let relative = path.strip_prefix(root).unwrap();
+        if exclude.is_match(relative) || include.is_some_and(|i| !i.is_match(relative)) {
+            continue;
+        }
+
+        match relative.to_str() {
+            Some(s) => files.push(s.to_owned()),
+            None => eprintln!("Skipping {path:?}, it is not valid UTF-8"),
+        }
+    }
+
+    Ok(())
+}
+
+fn read_lines(file: &Path, null: bool) -> io::Result<Vec<String>> {
+    Ok(read_strings(BufReader::new(File::open(file)?), null))
+}
+
+fn modified(file: &Path) -> Option<SystemTime> {
+    fs::metadata(file).and_then(|m| m.modified()).ok()
+}
+
+// Loads any new strings and soft removes any that are no longer present. Soft removes leave the
+// database unchanged, so only the loads are logged.
+fn sync(settings: &Settings, s: &mut Shuffler<String>, strings: Vec<String>) {
+    let strings: HashSet<_> = strings.into_iter().collect();
+
+    let vanished: Vec<_> =
+        s.values().into_iter().filter(|v| !strings.contains(*v)).cloned().collect();
+
+    for v in &vanished {
+        s.soft_remove(v).or_exit("Failed to write to the database");
+    }
+
+    let mut loaded = Vec::new();
+    for v in strings {
+        if s.load(v.clone()).or_exit("Failed to write to the database") {
+            loaded.push(v);
+        }
+    }
+    settings.record(Op::Add, &loaded);
+}
+
+fn watch(settings: &Settings, file: &Path) {
+    let strings = read_lines(file, settings.null)
+        .or_exit(format_args!("Failed to read strings from {file:?}"));
+    let strings = settings.relative_all(strings);
+
+    let mut s = settings.open_shuffler(Some(strings), true);
+
+    let (tx, rx) = mpsc::channel();
+
+    pick_on_stdin(tx.clone());
+
+    let poll_tx = tx.clone();
+    let poll_file = file.to_owned();
+    thread::spawn(move || {
+        let mut last = modified(&poll_file);
+        loop {
+            thread::sleep(Duration::from_secs(1));
+
+            let m = modified(&poll_file);
+            if m != last {
+                last = m;
+                if poll_tx.send(Event::Reload).is_err() {
+                    break;
+                }
+            }
+        }
+    });
+
+    reload_on_sighup(tx);
+
+    for event in rx {
+        match event {
+            Event::Pick(n) => print_picks(settings, &mut s, n, None),
+            Event::Add(_) | Event::Request(_) => unreachable!(),
+            Event::Reload => match read_lines(file, settings.null) {
+                Ok(strings) => sync(settings, &mut s, settings.relative_all(strings)),
+                // The file may be in the middle of being replaced, try again on the next change.
+                Err(e) => eprintln!("Failed to read strings from {file:?}: {e}"),
+            },
+            Event::Exit => break,
+        }
+    }
+
+    s.close_leak().or_exit("Failed to close the database");
+}
+
+fn watch_dir(
+    settings: &Settings,
+    root: &Path,
+    interval: Duration,
+    include: &[String],
+    exclude: &[String],
+) {
+    let include = if include.is_empty() { None } else { Some(globs(include)) };
+    let exclude = globs(exclude);
+
+    let scan = || {
+        let mut files = Vec::new();
+        walk(root, root, include.as_ref(), &exclude, &mut files).map(|()| files)
+    };
+
+    let files = scan().or_exit(format_args!("Failed to read directory {root:?}"));
+    let mut s = settings.open_shuffler(Some(files), true);
+
+    let (tx, rx) = mpsc::channel();
+
+    pick_on_stdin(tx.clone());
+
+    let timer_tx = tx.clone();
+    thread::spawn(move || {
+        loop {
+            thread::sleep(interval);
+            if timer_tx.send(Event::Reload).is_err() {
+                break;
+            }
+        }
+    });
+
+    reload_on_sighup(tx);
+
+    for event in rx {
+        match event {
+            Event::Pick(n) => print_picks(settings, &mut s, n, Some(root)),
+            Event::Add(_) | Event::Request(_) => unreachable!(),
+            Event::Reload => match scan() {
+                Ok(files) => sync(settings, &mut s, files),
+                // Files may be moved or deleted during the scan, try again next time.
+                Err(e) => eprintln!("Failed to read directory {root:?}: {e}"),
+            },
+            Event::Exit => break,
+        }
+    }
+
+    s.close_leak().or_exit("Failed to close the database");
+}
+
+// Reads numbers from stdin, picking that many strings for each one.
+fn pick_on_stdin(tx: Sender<Event>) {
+    thread::spawn(move || {
+        for line in io::stdin().lock().lines().map_while(Result::ok) {
+            match line.trim().parse() {
+                Ok(n) => drop(tx.send(Event::Pick(n))),
+                Err(e) => eprintln!("Invalid number {line:?}: {e}"),
+            }
+        }
+        drop(tx.send(Event::Exit));
+    });
+}
+
+fn stream(settings: &Settings, num: usize) {
+    let mut s = settings.open_shuffler(Some(Vec::new()), true);
+
+    let (tx, rx) = mpsc::channel();
+
+    let null = settings.null;
+    let stdin_tx = tx.clone();
+    thread::spawn(move || {
+        for line in read_strings_iter(io::stdin().lock(), null) {
+            if stdin_tx.send(Event::Add(line)).is_err() {
+                return;
+            }
+        }
+        drop(stdin_tx.send(Event::Exit));
+    });
+
+    pick_on_sigusr1(tx, num);
+
+    for event in rx {
+        match event {
+            Event::Add(line) => {
+                let line = settings.relative(line);
+                if s.load(line.clone()).or_exit("Failed to write to the database") {
+                    settings.record(Op::Add, slice::from_ref(&line));
+                }
+            }
+            Event::Pick(n) => print_picks(settings, &mut s, n, None),
+            Event::Reload | Event::Request(_) => unreachable!(),
+            Event::Exit => break,
+        }
+    }
+
+    s.close_leak().or_exit("Failed to close the database");
+}
+
+#[cfg(unix)]
+fn pick_on_sigusr1(tx: Sender<Event>, num: usize) {
+    use signal_hook::consts::SIGUSR1;
+    use signal_hook::iterator::Signals;
+
+    let mut signals = Signals::new([SIGUSR1]).or_exit("Failed to handle SIGUSR1");
+    thread::spawn(move || {
+        for _ in signals.forever() {
+            if tx.send(Event::Pick(num)).is_err() {
+                break;
+            }
+        }
+    });
+}
+
+#[cfg(not(unix))]
+fn pick_on_sigusr1(_tx: Sender<Event>, _num: usize) {}
 
-    s.close_leak().unwrap();
+#[cfg(unix)]
+fn reload_on_sighup(tx: Sender<Event>) {
+    use signal_hook::consts::SIGHUP;
+    use signal_hook::iterator::Signals;
+
+    let mut signals = Signals::new([SIGHUP]).or_exit("Failed to handle SIGHUP");
+    thread::spawn(move || {
+        for _ in signals.forever() {
+            if tx.send(Event::Reload).is_err() {
+                break;
+            }
+        }
+    });
 }
 
+#[cfg(not(unix))]
+fn reload_on_sighup(_tx: Sender<Event>) {}
+
 fn repair(db: &Path) {
     let mut options = Options::default();
     options.set_compression_type(rocksdb::DBCompressionType::Lz4);
 
-    DB::repair(&options, db).unwrap();
+    DB::repair(&options, db).or_exit(format_args!("Failed to repair the database at {db:?}"));
+}
+
+fn compact(settings: &Settings) {
+    let mut s = settings.open_shuffler(None, false);
+
+    s.compact().or_exit("Failed to compact the database");
+    s.close().or_exit("Failed to close the database");
+}
+
+fn verify(settings: &Settings) {
+    let path = &settings.db;
+    let mut options = Options::default();
+    options.set_compression_type(rocksdb::DBCompressionType::Lz4);
+
+    let db = settings.open(path, || open_all(&options, path));
+
+    let mut records = 0;
+    let mut problems = 0;
+
+    for entry in db.iterator(rocksdb::IteratorMode::Start) {
+        let (key, value) = match entry {
+            Ok(kv) => kv,
+            Err(e) => {
+                report(format_args!("Failed to read the database: {e}"));
+                problems += 1;
+                break;
+            }
+        };
+
+        records += 1;
+        if let Err(e) = verify_record(&key, &value) {
+            report(format_args!("Invalid record {:?}: {e}", String::from_utf8_lossy(&key)));
+            problems += 1;
+        }
+    }
+
+    drop(db);
+
+    match Shuffler::<String>::new(path, settings.shuffler_options(), None) {
+        Ok(s) => {
+            if let Err(e) = s.check_integrity() {
+                report(format_args!("Shuffler is inconsistent after loading: {e}"));
+                problems += 1;
+            }
+            s.close_leak().or_exit("Failed to close the database");
+        }
+        Err(e) => {
+            report(format_args!("Failed to load the database: {e}"));
+            problems += 1;
+        }
+    }
+
+    println!("Checked {records} records, found {problems} problems");
+    if problems > 0 {
+        fail(Exit::Corrupt, format_args!("The database at {path:?} has {problems} problems"));
+    }
+}
+
+fn verify_record(mut key: &[u8], mut value: &[u8]) -> Result<(), String> {
+    match rmpv::decode::value::read_value(&mut key) {
+        Ok(rmpv::Value::String(s)) if s.is_str() => {}
+        Ok(v) => return Err(format!("key {v} is not a string")),
+        Err(e) => return Err(format!("key could not be decoded: {e}")),
+    }
+
+    match rmpv::decode::value::read_value(&mut value) {
+        Ok(rmpv::Value::Integer(g)) if g.as_u64().is_some() => {}
+        Ok(v) => return Err(format!("generation {v} is not an unsigned integer")),
+        Err(e) => return Err(format!("generation could not be decoded: {e}")),
+    }
+
+    if !key.is_empty() || !value.is_empty() {
+        return Err("trailing bytes after the encoded value".to_owned());
+    }
+
+    Ok(())
+}
+
+// Resets every string when neither strings nor a pattern are given.
+fn reset(db: &DB, strings: Option<Vec<String>>, pattern: Option<&Regex>) {
+    let contents = decode_db(db, string_item);
+    let Some(min_gen) = contents.iter().map(|(_, g)| *g).min() else {
+        return;
+    };
+
+    let strings: Option<HashSet<_>> = strings.map(|s| s.into_iter().collect());
+    let min_gen = encode(min_gen.into());
+
+    let mut batch = WriteBatch::default();
+
+    for (s, _) in contents {
+        let selected = match pattern {
+            Some(p) => p.is_match(&s),
+            None => strings.as_ref().is_none_or(|set| set.contains(&s)),
+        };
+
+        if selected {
+            batch.put(encode(s.into()), &min_gen);
+        }
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+}
+
+fn read_renames(file: &Path) -> Vec<(String, String)> {
+    let lines = read_lines(file, false).or_exit(format_args!("Failed to read {file:?}"));
+
+    lines
+        .into_iter()
+        .enumerate()
+        .map(|(i, line)| match line.split_once('\t') {
+            Some((old, new)) => (old.to_owned(), new.to_owned()),
+            None => {
+                let msg = format!("Line {} is not in the format OLD<TAB>NEW: {line:?}", i + 1);
+                fail(Exit::Failure, msg)
+            }
+        })
+        .collect()
+}
+
+// With strict set it's an error for an old string to be missing, otherwise it's skipped.
+// Returns the renames that were applied.
+fn rename(db: &DB, renames: Vec<(String, String)>, strict: bool) -> Vec<(String, String)> {
+    let mut batch = WriteBatch::default();
+    let mut renamed = Vec::with_capacity(renames.len());
+
+    for (old, new) in renames {
+        let old_key = encode(old.as_str().into());
+
+        let Some(gen) = db.get(&old_key).or_exit("Failed to read from the database") else {
+            if strict {
+                fail(Exit::Failure, format_args!("{old:?} is not in the database"));
+            }
+            eprintln!("Skipping {old:?}, it is not in the database");
+            continue;
+        };
+
+        delete_key(db, &mut batch, &old_key);
+        put_key(db, &mut batch, &encode(new.as_str().into()), &gen);
+        renamed.push((old, new));
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+    renamed
+}
+
+fn remove(db: &DB, strings: &[String]) {
+    let mut batch = WriteBatch::default();
+
+    for s in strings {
+        delete_key(db, &mut batch, &encode(s.as_str().into()));
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+}
+
+fn prune(db: &DB, pattern: &Regex, dry_run: bool) -> Vec<String> {
+    let mut matched: Vec<_> = decode_db(db, string_item)
+        .into_iter()
+        .map(|(s, _)| s)
+        .filter(|s| pattern.is_match(s))
+        .collect();
+    matched.sort_unstable();
+
+    if dry_run {
+        return matched;
+    }
+
+    let mut batch = WriteBatch::default();
+
+    for s in &matched {
+        delete_key(db, &mut batch, &encode(s.as_str().into()));
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+    matched
+}
+
+fn touch(db: &DB, strings: Vec<String>) {
+    if strings.is_empty() {
+        return;
+    }
+
+    let max_gen = decode_db(db, string_item).into_iter().map(|(_, g)| g).max().unwrap_or(0);
+    let next_gen = encode(
+        max_gen
+            .checked_add(1)
+            .unwrap_or_else(|| {
+                fail(Exit::Failure, "Generations would overflow, reset the database first")
+            })
+            .into(),
+    );
+
+    let mut batch = WriteBatch::default();
+
+    for s in strings {
+        batch.put(encode(s.into()), &next_gen);
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+}
+
+// Deletes a string along with any record of it being soft removed, which would otherwise hide it
+// again if it were added back.
+fn delete_key(db: &DB, batch: &mut WriteBatch, key: &[u8]) {
+    batch.delete(key);
+    if let Some(hidden) = db.cf_handle(SOFT_REMOVED) {
+        batch.delete_cf(hidden, key);
+    }
+}
+
+// Writes a string as present in the database, clearing any record of it being soft removed.
+fn put_key(db: &DB, batch: &mut WriteBatch, key: &[u8], gen: &[u8]) {
+    batch.put(key, gen);
+    if let Some(hidden) = db.cf_handle(SOFT_REMOVED) {
+        batch.delete_cf(hidden, key);
+    }
+}
+
+// Opens every column family, since aw-shuffle may have added one for soft removed strings.
+fn open_all(options: &Options, db: &Path) -> Result<DB, rocksdb::Error> {
+    match DB::list_cf(options, db) {
+        Ok(cfs) => DB::open_cf(options, db, cfs),
+        Err(_) => DB::open(options, db),
+    }
+}
+
+// Matches the options aw-shuffle uses for its own databases.
+fn db_options() -> Options {
+    let mut options = Options::default();
+    options.set_compression_type(rocksdb::DBCompressionType::Lz4);
+    options.create_if_missing(true);
+    options
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn csv() {
+        assert_eq!(csv_escape("plain"), "plain");
+        assert_eq!(csv_escape("a,b"), "\"a,b\"");
+        assert_eq!(csv_escape("say \"hi\""), "\"say \"\"hi\"\"\"");
+        assert_eq!(csv_escape("two\nlines"), "\"two\nlines\"");
+        assert_eq!(csv_escape("cr\r"), "\"cr\r\"");
+        assert!(matches!(csv_escape("borrowed"), Cow::Borrowed(_)));
+    }
+
+    #[test]
+    fn verify_records() {
+        let key = encode("a".into());
+        let gen = encode(3u64.into());
+        assert_eq!(verify_record(&key, &gen), Ok(()));
+
+        let not_string = encode(rmpv::Value::Boolean(true));
+        assert!(verify_record(&not_string, &gen).unwrap_err().contains("not a string"));
+        let not_unsigned = encode(rmpv::Value::F64(1.5));
+        assert!(verify_record(&key, &not_unsigned).unwrap_err().contains("not an unsigned"));
+
+        // 0xc1 is never used by MessagePack.
+        assert!(verify_record(&[0xc1], &gen).unwrap_err().contains("key could not be decoded"));
+        assert!(verify_record(&key, &[]).unwrap_err().contains("generation could not be"));
+
+        let trailing = [gen.as_slice(), &[0]].concat();
+        assert!(verify_record(&key, &trailing).unwrap_err().contains("trailing bytes"));
+    }
 }
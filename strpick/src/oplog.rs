@@ -0,0 +1,140 @@
+use std::fs::OpenOptions;
+use std::io::Write;
+use std::path::Path;
+use std::time::SystemTime;
+
+use rocksdb::{WriteBatch, DB};
+use serde::{Deserialize, Serialize};
+
+use crate::error::{fail, Exit, OrExit};
+use crate::{decode_db, encode, put_key, read_lines, remove, rename, string_item, touch};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Op {
+    Add,
+    Remove,
+    Pick,
+    // Keys are pairs of old and new strings.
+    Rename,
+}
+
+/// One line of the log.
+#[derive(Serialize, Deserialize)]
+struct Entry {
+    time: String,
+    op: Op,
+    keys: Vec<String>,
+}
+
+pub fn append(log: &Path, op: Op, keys: Vec<String>) {
+    if keys.is_empty() {
+        return;
+    }
+
+    let entry = Entry {
+        time: humantime::format_rfc3339_seconds(SystemTime::now()).to_string(),
+        op,
+        keys,
+    };
+    let line = serde_json::to_string(&entry).unwrap();
+
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(log)
+        .or_exit(format_args!("Failed to open the log {log:?}"));
+
+    // A single write so concurrent processes don't interleave lines.
+    file.write_all(format!("{line}\n").as_bytes())
+        .or_exit(format_args!("Failed to write to the log {log:?}"));
+}
+
+pub fn replay(db: &DB, log: &Path) {
+    let lines = read_lines(log, false).or_exit(format_args!("Failed to read {log:?}"));
+
+    for (i, line) in lines.iter().enumerate().filter(|(_, l)| !l.is_empty()) {
+        let entry: Entry = serde_json::from_str(line).unwrap_or_else(|e| {
+            fail(Exit::Failure, format_args!("Invalid entry on line {} of {log:?}: {e}", i + 1))
+        });
+
+        match entry.op {
+            Op::Add => add(db, entry.keys),
+            Op::Remove => remove(db, &entry.keys),
+            Op::Pick => touch(db, entry.keys),
+            Op::Rename => {
+                let renames = entry.keys.chunks_exact(2).map(|p| (p[0].clone(), p[1].clone()));
+                rename(db, renames.collect(), false);
+            }
+        }
+    }
+}
+
+// Matches how strpick adds strings by default, as if they had never been picked.
+fn add(db: &DB, strings: Vec<String>) {
+    let min_gen = decode_db(db, string_item).into_iter().map(|(_, g)| g).min().unwrap_or(0);
+    let min_gen = encode(min_gen.into());
+
+    let mut batch = WriteBatch::default();
+
+    for s in strings {
+        let key = encode(s.into());
+        if db.get_pinned(&key).or_exit("Failed to read from the database").is_none() {
+            put_key(db, &mut batch, &key, &min_gen);
+        }
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+}
+
+#[cfg(test)]
+mod tests {
+    use tempfile::tempdir;
+
+    use super::*;
+    use crate::{db_options, open_all};
+
+    fn strings(items: &[&str]) -> Vec<String> {
+        items.iter().map(|s| (*s).to_owned()).collect()
+    }
+
+    #[test]
+    fn entries() {
+        let dir = tempdir().unwrap();
+        let log = dir.path().join("log");
+
+        append(&log, Op::Add, strings(&["a", "b"]));
+        append(&log, Op::Pick, Vec::new());
+        append(&log, Op::Rename, strings(&["b", "c"]));
+
+        let entries: Vec<Entry> = read_lines(&log, false)
+            .unwrap()
+            .iter()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+
+        // Empty operations aren't written.
+        let ops: Vec<_> = entries.iter().map(|e| (e.op, e.keys.clone())).collect();
+        assert_eq!(ops, vec![(Op::Add, strings(&["a", "b"])), (Op::Rename, strings(&["b", "c"]))]);
+        assert!(humantime::parse_rfc3339(&entries[0].time).is_ok());
+    }
+
+    #[test]
+    fn replay_log() {
+        let dir = tempdir().unwrap();
+        let log = dir.path().join("log");
+
+        append(&log, Op::Add, strings(&["a", "b", "c"]));
+        append(&log, Op::Pick, strings(&["a"]));
+        append(&log, Op::Rename, strings(&["b", "d"]));
+        append(&log, Op::Remove, strings(&["c"]));
+
+        let db = open_all(&db_options(), &dir.path().join("db")).unwrap();
+        replay(&db, &log);
+
+        let mut records = decode_db(&db, string_item);
+        records.sort_unstable();
+        assert_eq!(records, vec![("a".to_owned(), 1), ("d".to_owned(), 0)]);
+    }
+}
@@ -0,0 +1,121 @@
+use std::io::{self, Read, Write};
+use std::net::{TcpStream, ToSocketAddrs};
+use std::thread;
+use std::time::Duration;
+
+use serde_json::Value;
+
+// Applies separately to connecting, sending, and receiving.
+const TIMEOUT: Duration = Duration::from_secs(10);
+// Connections that fail before a response is read are retried, as the server may be restarting.
+const ATTEMPTS: usize = 3;
+const RETRY_DELAY: Duration = Duration::from_millis(500);
+
+/// A client for a database shared with the serve command.
+pub struct Client {
+    addr: String,
+    token: Option<String>,
+}
+
+impl Client {
+    // Accepts "HOST:PORT" with or without a leading "http://".
+    pub fn new(url: &str, token: Option<String>) -> Self {
+        let addr = url.strip_prefix("http://").unwrap_or(url).trim_end_matches('/');
+        Self { addr: addr.to_owned(), token }
+    }
+
+    pub fn pick(&self, num: usize) -> io::Result<Vec<String>> {
+        let picked = self.request("POST", &format!("/pick?n={num}"), "")?;
+        serde_json::from_value(picked).map_err(io::Error::other)
+    }
+
+    // Returns the number of strings that weren't already present.
+    pub fn add(&self, strings: &[String]) -> io::Result<u64> {
+        let resp = self.request("POST", "/add", &strings.join("\n"))?;
+        Ok(resp["added"].as_u64().unwrap_or(0))
+    }
+
+    // Each request uses a new connection, so there's no connection to go stale between requests.
+    fn request(&self, method: &str, path: &str, body: &str) -> io::Result<Value> {
+        let mut last_err = None;
+
+        for attempt in 0..ATTEMPTS {
+            if attempt > 0 {
+                thread::sleep(RETRY_DELAY);
+            }
+
+            let mut stream = match self.connect() {
+                Ok(s) => s,
+                Err(e) => {
+                    last_err = Some(e);
+                    continue;
+                }
+            };
+
+            // Requests can't be retried once they've been sent, as they may have been handled.
+            self.send(&mut stream, method, path, body)?;
+            return read_response(&mut stream);
+        }
+
+        Err(last_err.unwrap())
+    }
+
+    fn connect(&self) -> io::Result<TcpStream> {
+        let mut last_err = None;
+
+        for addr in self.addr.to_socket_addrs()? {
+            match TcpStream::connect_timeout(&addr, TIMEOUT) {
+                Ok(stream) => {
+                    stream.set_read_timeout(Some(TIMEOUT))?;
+                    stream.set_write_timeout(Some(TIMEOUT))?;
+                    return Ok(stream);
+                }
+                Err(e) => last_err = Some(e),
+            }
+        }
+
+        Err(last_err.unwrap_or_else(|| {
+            io::Error::new(io::ErrorKind::NotFound, format!("{} did not resolve", self.addr))
+        }))
+    }
+
+    fn send(&self, stream: &mut TcpStream, method: &str, path: &str, body: &str) -> io::Result<()> {
+        let mut req = format!(
+            "{method} {path} HTTP/1.0\r\nHost: {}\r\nContent-Length: {}\r\n",
+            self.addr,
+            body.len()
+        );
+        if let Some(token) = &self.token {
+            req.push_str(&format!("Authorization: Bearer {token}\r\n"));
+        }
+        req.push_str("\r\n");
+        req.push_str(body);
+
+        stream.write_all(req.as_bytes())?;
+        stream.flush()
+    }
+}
+
+// HTTP/1.0 responses are never chunked and end when the server closes the connection.
+fn read_response(stream: &mut TcpStream) -> io::Result<Value> {
+    let mut resp = String::new();
+    stream.read_to_string(&mut resp)?;
+
+    let invalid = || io::Error::new(io::ErrorKind::InvalidData, "invalid response from server");
+
+    let (head, body) = resp.split_once("\r\n\r\n").ok_or_else(invalid)?;
+    let status: u16 = head
+        .lines()
+        .next()
+        .and_then(|line| line.split_whitespace().nth(1))
+        .and_then(|code| code.parse().ok())
+        .ok_or_else(invalid)?;
+
+    let body: Value = serde_json::from_str(body).map_err(|_| invalid())?;
+    if (200..300).contains(&status) {
+        return Ok(body);
+    }
+
+    let msg = body["error"].as_str().unwrap_or("unknown error");
+    Err(io::Error::other(format!("server returned {status}: {msg}")))
+}
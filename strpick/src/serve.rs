@@ -0,0 +1,340 @@
+use std::io::{self, Cursor};
+use std::path::Path;
+use std::sync::mpsc;
+use std::thread;
+
+use aw_shuffle::persistent::rocksdb::Shuffler;
+use aw_shuffle::persistent::PersistentShuffler;
+use aw_shuffle::AwShuffler;
+use globset::GlobSet;
+use serde_json::{json, Value};
+use tiny_http::{Header, Method, Request, Response, Server};
+
+use crate::error::{fail, Exit, OrExit};
+use crate::oplog::Op;
+use crate::{read_lines, reload_on_sighup, sync, walk, Event, Settings};
+
+type Resp = Response<Cursor<Vec<u8>>>;
+
+// Larger requests are rejected so one request can't make the server build an enormous response.
+const MAX_PICK: usize = 10_000;
+
+/// Where the served strings come from, if they aren't only added through requests.
+pub enum Source<'a> {
+    File(&'a Path),
+    // Files are stored relative to the directory, like with watch-dir.
+    Dir(&'a Path),
+}
+
+impl Source<'_> {
+    fn read(&self, settings: &Settings) -> io::Result<Vec<String>> {
+        match self {
+            Self::File(file) => read_lines(file, settings.null).map(|s| settings.relative_all(s)),
+            Self::Dir(root) => {
+                let mut files = Vec::new();
+                walk(root, root, None, &GlobSet::empty(), &mut files).map(|()| files)
+            }
+        }
+    }
+
+    const fn root(&self) -> Option<&Path> {
+        match self {
+            Self::File(_) => None,
+            Self::Dir(root) => Some(root),
+        }
+    }
+}
+
+/// The tokens requests must send, if any.
+pub struct Tokens<'a> {
+    pub full: Option<&'a str>,
+    // Only allows requests that don't change anything.
+    pub read: Option<&'a str>,
+}
+
+#[derive(Debug, PartialEq, Eq)]
+enum Access {
+    Denied,
+    Read,
+    Full,
+}
+
+// Requests are handled one at a time, so there's only ever one writer to the database. Reloads
+// happen between requests so none are dropped.
+pub fn serve(
+    mut settings: Settings,
+    addr: &str,
+    tokens: Tokens,
+    source: Option<Source>,
+    reload: impl Fn() -> Result<Settings, String>,
+) {
+    // Allow ":8080" as shorthand for listening on every interface.
+    let addr = if addr.starts_with(':') { format!("0.0.0.0{addr}") } else { addr.to_owned() };
+
+    let strings = source
+        .as_ref()
+        .map(|src| src.read(&settings).or_exit("Failed to read the strings to serve"));
+    let mut pickers = vec![(name(&settings.db), settings.open_shuffler(strings, source.is_some()))];
+    for db in &settings.extra_dbs {
+        let name = name(db);
+        if pickers.iter().any(|(n, _)| *n == name) {
+            fail(Exit::Usage, format_args!("Multiple databases are named {name:?}"))
+        }
+        pickers.push((name, settings.open_shuffler_at(db, None, false)));
+    }
+    let root = source.as_ref().and_then(Source::root);
+
+    let server = Server::http(&addr).or_exit(format_args!("Failed to listen on {addr}"));
+
+    let (tx, rx) = mpsc::channel();
+
+    let req_tx = tx.clone();
+    thread::spawn(move || {
+        for req in server.incoming_requests() {
+            if req_tx.send(Event::Request(req)).is_err() {
+                break;
+            }
+        }
+    });
+
+    reload_on_sighup(tx);
+
+    for event in rx {
+        match event {
+            Event::Request(mut req) => {
+                let resp = match allowed(access(bearer(&req), &tokens), req.method()) {
+                    Ok(()) => route(&settings, &mut pickers, root, &mut req),
+                    Err((code, msg)) => error(code, msg),
+                };
+
+                if let Err(e) = req.respond(resp) {
+                    eprintln!("Failed to send response: {e}");
+                }
+            }
+            Event::Reload => {
+                match reload() {
+                    Ok(new) => {
+                        if new.db != settings.db {
+                            eprintln!("Changing the database requires a restart");
+                        }
+                        for (_, s) in &mut pickers {
+                            s.set_bias(new.bias);
+                        }
+                        settings = new;
+                    }
+                    // Keep serving with the old settings until the config is fixed.
+                    Err(e) => eprintln!("Failed to reload settings: {e}"),
+                }
+
+                if let Some(src) = &source {
+                    match src.read(&settings) {
+                        Ok(strings) => sync(&settings, &mut pickers[0].1, strings),
+                        Err(e) => eprintln!("Failed to read the strings to serve: {e}"),
+                    }
+                }
+            }
+            Event::Add(_) | Event::Pick(_) | Event::Exit => unreachable!(),
+        }
+    }
+
+    for (_, s) in pickers {
+        s.close_leak().or_exit("Failed to close the database");
+    }
+}
+
+// Databases are named after the last component of their paths, like named databases.
+fn name(db: &Path) -> String {
+    db.file_name().map_or_else(String::new, |n| n.to_string_lossy().into_owned())
+}
+
+// Requests for "/NAME/..." go to the database NAME, anything else goes to the first database.
+fn route(
+    settings: &Settings,
+    pickers: &mut [(String, Shuffler<String>)],
+    root: Option<&Path>,
+    req: &mut Request,
+) -> Resp {
+    let url = req.url().to_owned();
+    let (path, query) = url.split_once('?').unwrap_or((&url, ""));
+
+    if path == "/pickers" {
+        if *req.method() != Method::Get {
+            return error(405, "method not allowed");
+        }
+        let stats: serde_json::Map<_, _> =
+            pickers.iter().map(|(name, s)| (name.clone(), stats(s))).collect();
+        return ok(Value::Object(stats));
+    }
+
+    let prefixed = path.strip_prefix('/').and_then(|p| p.split_once('/')).and_then(|(n, _)| {
+        let i = pickers.iter().position(|(name, _)| name == n)?;
+        Some((i, &path[n.len() + 1..]))
+    });
+
+    match prefixed {
+        // Only the first database is synchronized with --file or --dir.
+        Some((i, path)) => {
+            let root = if i == 0 { root } else { None };
+            handle(settings, &mut pickers[i].1, root, req, path, query)
+        }
+        None => handle(settings, &mut pickers[0].1, root, req, path, query),
+    }
+}
+
+fn stats(s: &Shuffler<String>) -> Value {
+    let gens: Vec<_> = s.dump().into_iter().map(|(_, g)| g).collect();
+
+    json!({
+        "size": s.size(),
+        "min_generation": gens.iter().min(),
+        "max_generation": gens.iter().max(),
+    })
+}
+
+fn bearer(req: &Request) -> Option<&str> {
+    req.headers()
+        .iter()
+        .find(|h| h.field.equiv("Authorization"))
+        .and_then(|h| h.value.as_str().strip_prefix("Bearer "))
+}
+
+fn access(sent: Option<&str>, tokens: &Tokens) -> Access {
+    let Some(full) = tokens.full else {
+        return Access::Full;
+    };
+
+    match sent {
+        Some(t) if t == full => Access::Full,
+        Some(t) if Some(t) == tokens.read => Access::Read,
+        _ => Access::Denied,
+    }
+}
+
+// Returns the status and message to reject the request with, if it isn't allowed.
+fn allowed(access: Access, method: &Method) -> Result<(), (u16, &'static str)> {
+    match access {
+        Access::Full => Ok(()),
+        Access::Read if *method == Method::Get => Ok(()),
+        Access::Read => Err((403, "token does not allow changes")),
+        Access::Denied => Err((401, "missing or invalid token")),
+    }
+}
+
+fn handle(
+    settings: &Settings,
+    s: &mut Shuffler<String>,
+    root: Option<&Path>,
+    req: &mut Request,
+    path: &str,
+    query: &str,
+) -> Resp {
+    match (req.method(), path) {
+        (Method::Post, "/pick") => {
+            let n = match param(query, "n").map(str::parse).transpose() {
+                Ok(n) => n.unwrap_or(1),
+                Err(e) => return error(400, &format!("invalid n: {e}")),
+            };
+            if n > MAX_PICK {
+                return error(400, &format!("n can be at most {MAX_PICK}"));
+            }
+
+            let picked: Vec<_> = match s.try_unique_n(n) {
+                Ok(picked) => picked.into_iter().flatten().cloned().collect(),
+                Err(e) => return error(500, &format!("failed to write to the database: {e}")),
+            };
+            settings.record(Op::Pick, &picked);
+            let paths: Vec<_> = picked
+                .into_iter()
+                .map(|p| match root {
+                    Some(root) => root.join(p).to_string_lossy().into_owned(),
+                    None => settings.absolute(p),
+                })
+                .collect();
+            ok(json!(paths))
+        }
+        // Takes newline separated strings in the body.
+        (Method::Post, "/add") => {
+            let mut body = String::new();
+            if let Err(e) = req.as_reader().read_to_string(&mut body) {
+                return error(400, &format!("invalid body: {e}"));
+            }
+
+            let mut added = Vec::new();
+            let mut result = Ok(());
+            for line in body.lines().filter(|l| !l.is_empty()) {
+                let line = settings.relative(line.to_owned());
+                match s.add(line.clone()) {
+                    Ok(true) => added.push(line),
+                    Ok(false) => {}
+                    Err(e) => {
+                        result = Err(e);
+                        break;
+                    }
+                }
+            }
+            // Strings added before a failure are still recorded.
+            settings.record(Op::Add, &added);
+            if let Err(e) = result {
+                return error(500, &format!("failed to write to the database: {e}"));
+            }
+
+            ok(json!({"added": added.len(), "size": s.size()}))
+        }
+        (Method::Get, "/values") => {
+            let mut values = s.values();
+            values.sort_unstable();
+            ok(json!(values))
+        }
+        (Method::Get, "/stats") => ok(stats(s)),
+        (Method::Get, "/health") => match s.check_health() {
+            Ok(()) => ok(json!({"healthy": true})),
+            Err(e) => error(503, &e),
+        },
+        (_, "/pick" | "/add" | "/values" | "/stats" | "/health") => {
+            error(405, "method not allowed")
+        }
+        _ => error(404, "not found"),
+    }
+}
+
+fn param<'a>(query: &'a str, name: &str) -> Option<&'a str> {
+    query.split('&').filter_map(|kv| kv.split_once('=')).find(|(k, _)| *k == name).map(|(_, v)| v)
+}
+
+fn ok(body: Value) -> Resp {
+    Response::from_string(body.to_string())
+        .with_header(Header::from_bytes("Content-Type", "application/json").unwrap())
+}
+
+fn error(code: u16, msg: &str) -> Resp {
+    ok(json!({ "error": msg })).with_status_code(code)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const TOKENS: Tokens = Tokens { full: Some("full"), read: Some("read") };
+
+    #[test]
+    fn access_tokens() {
+        assert_eq!(access(Some("full"), &TOKENS), Access::Full);
+        assert_eq!(access(Some("read"), &TOKENS), Access::Read);
+        assert_eq!(access(Some("other"), &TOKENS), Access::Denied);
+        assert_eq!(access(None, &TOKENS), Access::Denied);
+
+        // Without a full token every request is allowed, even without a read token.
+        let open = Tokens { full: None, read: Some("read") };
+        assert_eq!(access(None, &open), Access::Full);
+        let no_read = Tokens { full: Some("full"), read: None };
+        assert_eq!(access(Some("read"), &no_read), Access::Denied);
+    }
+
+    #[test]
+    fn read_token_methods() {
+        assert_eq!(allowed(Access::Read, &Method::Get), Ok(()));
+        assert_eq!(allowed(Access::Read, &Method::Post).unwrap_err().0, 403);
+        assert_eq!(allowed(Access::Full, &Method::Post), Ok(()));
+        assert_eq!(allowed(Access::Denied, &Method::Get).unwrap_err().0, 401);
+    }
+}
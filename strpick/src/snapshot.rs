@@ -0,0 +1,102 @@
+use std::ffi::OsString;
+use std::fs;
+use std::io::ErrorKind;
+use std::path::{Path, PathBuf};
+
+use rocksdb::checkpoint::Checkpoint;
+use rocksdb::{IteratorMode, WriteBatch, DB};
+
+use crate::{db_options, SOFT_REMOVED};
+use crate::error::{fail, Exit, OrExit};
+
+// Snapshots live next to the database rather than inside it so that nothing opening the database
+// needs to know about them.
+fn snapshot_dir(db: &Path) -> PathBuf {
+    let mut dir = OsString::from(db.as_os_str());
+    dir.push(".snapshots");
+    dir.into()
+}
+
+fn snapshot_path(db: &Path, name: &str) -> PathBuf {
+    if name.is_empty() || name == "." || name == ".." || name.contains(['/', '\\']) {
+        fail(Exit::Usage, format_args!("Invalid snapshot name {name:?}"));
+    }
+
+    snapshot_dir(db).join(name)
+}
+
+// RocksDB checkpoints hard link the database files when possible, so snapshots are cheap.
+pub fn snapshot(db: &DB, path: &Path, name: &str) {
+    let snapshot = snapshot_path(path, name);
+    if snapshot.exists() {
+        fail(Exit::Failure, format_args!("Snapshot {name:?} already exists"));
+    }
+
+    let dir = snapshot_dir(path);
+    fs::create_dir_all(&dir).or_exit(format_args!("Failed to create {dir:?}"));
+
+    Checkpoint::new(db)
+        .and_then(|c| c.create_checkpoint(&snapshot))
+        .or_exit(format_args!("Failed to create snapshot {name:?}"));
+}
+
+pub fn list(db: &Path) -> Vec<String> {
+    let dir = snapshot_dir(db);
+
+    let entries = match fs::read_dir(&dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == ErrorKind::NotFound => return Vec::new(),
+        Err(e) => fail(Exit::Failure, format_args!("Failed to read {dir:?}: {e}")),
+    };
+
+    let mut names: Vec<_> = entries
+        .map(|e| e.or_exit(format_args!("Failed to read {dir:?}")))
+        .map(|e| e.file_name().to_string_lossy().into_owned())
+        .collect();
+    names.sort_unstable();
+    names
+}
+
+// Replaces the contents of the database, including any soft removed strings, in a single batch.
+// The snapshot itself is kept.
+pub fn rollback(db: &DB, path: &Path, name: &str) {
+    let snapshot = snapshot_path(path, name);
+    if !snapshot.exists() {
+        fail(Exit::Failure, format_args!("Snapshot {name:?} does not exist"));
+    }
+
+    let cfs = DB::list_cf(&db_options(), &snapshot)
+        .or_exit(format_args!("Failed to open snapshot {name:?}"));
+    let snapshot = DB::open_cf_for_read_only(&db_options(), &snapshot, cfs, false)
+        .or_exit(format_args!("Failed to open snapshot {name:?}"));
+
+    let mut batch = WriteBatch::default();
+
+    for r in db.iterator(IteratorMode::Start) {
+        let (key, _) = r.or_exit("Failed to read from the database");
+        batch.delete(key);
+    }
+
+    for r in snapshot.iterator(IteratorMode::Start) {
+        let (key, value) = r.or_exit(format_args!("Failed to read snapshot {name:?}"));
+        batch.put(key, value);
+    }
+
+    // Column families are never dropped, so the database has one whenever its snapshots do.
+    if let Some(hidden) = db.cf_handle(SOFT_REMOVED) {
+        for r in db.iterator_cf(hidden, IteratorMode::Start) {
+            let (key, _) = r.or_exit("Failed to read from the database");
+            batch.delete_cf(hidden, key);
+        }
+
+        if let Some(snapshot_hidden) = snapshot.cf_handle(SOFT_REMOVED) {
+            for r in snapshot.iterator_cf(snapshot_hidden, IteratorMode::Start) {
+                let (key, value) = r.or_exit(format_args!("Failed to read snapshot {name:?}"));
+                batch.put_cf(hidden, key, value);
+            }
+        }
+    }
+
+    db.write(batch).or_exit("Failed to write to the database");
+    db.flush().or_exit("Failed to write to the database");
+}
@@ -0,0 +1,109 @@
+/// A user provided format for output lines, such as "{key}\t{generation}".
+#[derive(Clone, Debug)]
+pub struct Template(Vec<Part>);
+
+#[derive(Clone, Debug)]
+enum Part {
+    Literal(String),
+    Key,
+    Generation,
+}
+
+impl Template {
+    // Escapes are handled here since shells make it awkward to pass tabs and newlines.
+    pub fn parse(s: &str) -> Result<Self, String> {
+        let mut parts = Vec::new();
+        let mut literal = String::new();
+        let mut rest = s;
+
+        while let Some(i) = rest.find(['\\', '{']) {
+            literal.push_str(&rest[..i]);
+            // Both '\\' and '{' are a single byte.
+            let (special, tail) = rest[i..].split_at(1);
+
+            if special == "\\" {
+                let mut chars = tail.chars();
+                literal.push(match chars.next() {
+                    Some('t') => '\t',
+                    Some('n') => '\n',
+                    Some('0') => '\0',
+                    Some(c @ ('\\' | '{')) => c,
+                    _ => return Err(format!("invalid escape sequence in {s:?}")),
+                });
+                rest = chars.as_str();
+                continue;
+            }
+
+            let Some((name, tail)) = tail.split_once('}') else {
+                return Err(format!("unclosed {{ in {s:?}"));
+            };
+
+            parts.push(Part::Literal(std::mem::take(&mut literal)));
+            parts.push(match name {
+                "key" => Part::Key,
+                "generation" => Part::Generation,
+                _ => {
+                    return Err(format!(
+                        "unknown field {{{name}}}, expected {{key}} or {{generation}}"
+                    ));
+                }
+            });
+            rest = tail;
+        }
+
+        literal.push_str(rest);
+        parts.push(Part::Literal(literal));
+        Ok(Self(parts))
+    }
+
+    pub fn uses_generation(&self) -> bool {
+        self.0.iter().any(|p| matches!(p, Part::Generation))
+    }
+
+    // The generation is left blank when it isn't known.
+    pub fn render(&self, key: &str, generation: Option<u64>) -> String {
+        let mut out = String::new();
+
+        for p in &self.0 {
+            match p {
+                Part::Literal(l) => out.push_str(l),
+                Part::Key => out.push_str(key),
+                Part::Generation => {
+                    if let Some(g) = generation {
+                        out.push_str(&g.to_string());
+                    }
+                }
+            }
+        }
+
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn render() {
+        let t = Template::parse("{key}\\t{generation}").unwrap();
+        assert!(t.uses_generation());
+        assert_eq!(t.render("a", Some(3)), "a\t3");
+        assert_eq!(t.render("a", None), "a\t");
+
+        let t = Template::parse("\\{key} = {key}\\n").unwrap();
+        assert!(!t.uses_generation());
+        assert_eq!(t.render("b", Some(3)), "{key} = b\n");
+
+        assert_eq!(Template::parse("").unwrap().render("c", None), "");
+        assert_eq!(Template::parse("\\\\\\0").unwrap().render("c", None), "\\\0");
+    }
+
+    #[test]
+    fn parse_errors() {
+        assert!(Template::parse("{key").unwrap_err().contains("unclosed"));
+        assert!(Template::parse("{value}").unwrap_err().contains("unknown field {value}"));
+        assert!(Template::parse("\\x").unwrap_err().contains("invalid escape"));
+        assert!(Template::parse("trailing \\").unwrap_err().contains("invalid escape"));
+    }
+}